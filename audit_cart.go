@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// DinerIDHeader names the diner making an update, who is recorded as its
+// author in the history of the cart
+const DinerIDHeader = "X-Diner-ID"
+
+// the query param of reads of the cart as of a version or an RFC 3339 timestamp
+const atParam = "at"
+
+// how many revisions of the history are listed per page unless asked for fewer
+const (
+	defaultHistoryPageSize = 20
+	maxHistoryPageSize     = 100
+)
+
+// stream entry IDs, by which the history is paginated
+var revisionIDPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// the payload of an update as recorded, compacted if JSON and otherwise
+// recorded as a JSON string so that the history is JSON throughout
+func auditPayload(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, body); err == nil {
+		return compacted.Bytes()
+	}
+	// marshaling strings cannot fail
+	payload, _ := json.Marshal(string(body))
+	return payload
+}
+
+// bodies of updates hold at most a cart, which is no larger than the limit of
+// bytes once encoded as JSON, with as much again to spare for how clients
+// format it, and for the fields of the request around it
+func maxUpdateBodyBytes(limits CartLimits) int64 {
+	return 2 * int64(limits.MaxBytes)
+}
+
+// withUpdateAudit records the diner in DinerIDHeader and the body of the
+// request in the history of the carts that it updates, responding with 413
+// to bodies over maxUpdateBodyBytes rather than reading them in whole
+func withUpdateAudit(limits CartLimits, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxBytes := maxUpdateBodyBytes(limits)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+		if err != nil && int64(len(body)) >= maxBytes {
+			writeProblem(w, http.StatusRequestEntityTooLarge, tooLargeProblem, fmt.Sprintf("the body must be at most %d bytes", maxBytes), nil)
+			return
+		}
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, badRequestProblem, "the body cannot be read", nil)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		audit := UpdateAudit{Author: DinerID(r.Header.Get(DinerIDHeader)), Payload: auditPayload(body)}
+		next.ServeHTTP(w, r.WithContext(WithUpdateAudit(r.Context(), audit)))
+	})
+}
+
+// the body of responses listing the history of a cart
+type historyBody struct {
+	Revisions []CartRevision `json:"revisions"`
+	// the before param of the next page, if there may be one
+	Next string `json:"next,omitempty"`
+}
+
+// ReadCartHistoryWithContext responds with the revisions of the cart, newest
+// first, a page of up to the limit param at a time, starting with those before
+// the revision in the before param
+func ReadCartHistoryWithContext(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+	historyReader, ok := cartReader.(CartHistoryReader)
+	if !ok {
+		writeProblem(w, http.StatusNotImplemented, notImplementedProblem, "cart histories cannot be read", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := int64(defaultHistoryPageSize)
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 || limit > maxHistoryPageSize {
+			writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("limit must be between 1 and %d", maxHistoryPageSize), nil)
+			return
+		}
+	}
+	before := query.Get("before")
+	if before != "" && !revisionIDPattern.MatchString(before) {
+		writeProblem(w, http.StatusBadRequest, badRequestProblem, "before must be the ID of a revision", nil)
+		return
+	}
+
+	revisions, err := historyReader.ReadCartHistoryWithContext(ctx, cartID, before, limit)
+	if err != nil {
+		log.Println(err.Error())
+		writeErrorProblem(ctx, w, err)
+		return
+	}
+
+	body := historyBody{Revisions: revisions}
+	if int64(len(revisions)) == limit {
+		body.Next = revisions[len(revisions)-1].ID
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// reads the cart as of the at param if given, either a version or an RFC 3339
+// timestamp, or as it is otherwise, responding with a problem if the cart
+// cannot be read
+func readCartAt(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request, cartID string) (Cart, bool) {
+	var currentCart Cart
+	var err error
+	at := r.URL.Query().Get(atParam)
+	if at == "" {
+		currentCart, err = cartReader.ReadCartWithContext(ctx, cartID)
+	} else {
+		historyReader, ok := cartReader.(CartHistoryReader)
+		if !ok {
+			writeProblem(w, http.StatusNotImplemented, notImplementedProblem, "carts cannot be read as they were", nil)
+			return Cart{}, false
+		}
+
+		if version, parseErr := strconv.ParseInt(at, 10, 64); parseErr == nil && version >= 0 {
+			currentCart, err = historyReader.ReadCartAtVersionWithContext(ctx, cartID, version)
+		} else if timestamp, parseErr := time.Parse(time.RFC3339Nano, at); parseErr == nil {
+			currentCart, err = historyReader.ReadCartAtTimeWithContext(ctx, cartID, timestamp)
+		} else {
+			writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("%s must be a version of the cart or an RFC 3339 timestamp", atParam), nil)
+			return Cart{}, false
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+		writeErrorProblem(ctx, w, err)
+		return Cart{}, false
+	}
+
+	return currentCart, true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// serves the request as the diner, if any
+func serveRouterAs(t *testing.T, router http.Handler, dinerID DinerID, method string, url string, requestBody string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, url, bytes.NewBufferString(requestBody))
+	if dinerID != "" {
+		request.Header.Set(DinerIDHeader, string(dinerID))
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestRouterRecordsAuthorsAndPayloadsInCartHistory(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	response := serveRouterAs(t, router, "diner1", "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1}, "fries": {"diner2": 1}}}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	response = serveRouterAs(t, router, "diner2", "DELETE", "/carts/"+cartID+"/items/fries", "")
+	require.Equal(t, http.StatusNoContent, response.Code)
+	response = serveRouterAs(t, router, "", "PUT", "/carts/"+cartID+"/items/food/diners/diner1", "not json")
+	require.NotEqual(t, http.StatusOK, response.Code)
+
+	var history historyBody
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/history", "", &history)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Len(t, history.Revisions, 2)
+	require.Empty(t, history.Next)
+
+	require.Equal(t, int64(2), history.Revisions[0].Version)
+	require.Equal(t, DinerID("diner2"), history.Revisions[0].Author)
+	require.Nil(t, history.Revisions[0].Payload)
+	require.Equal(t, []QuantityChange{{ItemID: "fries", DinerID: "diner2", Before: 1, After: 0}}, history.Revisions[0].Changes)
+
+	require.Equal(t, int64(1), history.Revisions[1].Version)
+	require.Equal(t, DinerID("diner1"), history.Revisions[1].Author)
+	require.JSONEq(t, `{"cart_details": {"food": {"diner1": 1}, "fries": {"diner2": 1}}}`, string(history.Revisions[1].Payload))
+}
+
+func TestRouterRecordsPayloadsThatAreNotJSONAsStrings(t *testing.T) {
+	require.Equal(t, json.RawMessage(`{"a":1}`), auditPayload([]byte(" {\"a\": 1}\n")))
+	require.Equal(t, json.RawMessage(`"quantity=1"`), auditPayload([]byte("quantity=1")))
+	require.Nil(t, auditPayload([]byte(" \n")))
+}
+
+func TestRouterRejectsUpdateBodiesTooLargeToAudit(t *testing.T) {
+	client := MustRedisTestClient()
+	limits := DefaultCartLimits()
+	limits.MaxBytes = 100
+	router := newRouter(DefaultConfig().HTTP, limits, MustRedisCartUpdater(client, WithCartLimits(limits)), MustRedisCartReader(client), nil)
+	cartID := uuid.NewV4().String()
+
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}, "padding": "`+strings.Repeat(" ", 200)+`"}`, nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+	require.Equal(t, tooLargeProblem, mustDecodeProblem(t, response).Code)
+	response = serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	var history historyBody
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/history", "", &history)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Len(t, history.Revisions, 1)
+}
+
+func TestRouterPaginatesCartHistory(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	for _, body := range []string{`{"food": {"diner": 1}}`, `{"food": {"diner": 2}}`, `{"food": {"diner": 3}}`} {
+		response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": `+body+`}`, nil)
+		require.Equal(t, http.StatusOK, response.Code)
+	}
+
+	var history historyBody
+	var versions []int64
+	path := "/carts/" + cartID + "/history?limit=2"
+	for {
+		response := serveRouter(t, router, "GET", path, "", &history)
+		require.Equal(t, http.StatusOK, response.Code)
+		for _, revision := range history.Revisions {
+			versions = append(versions, revision.Version)
+		}
+		if history.Next == "" {
+			break
+		}
+		path = "/carts/" + cartID + "/history?limit=2&before=" + url.QueryEscape(history.Next)
+	}
+	require.Equal(t, []int64{3, 2, 1}, versions)
+}
+
+func TestRouterRejectsInvalidCartHistoryPages(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	for _, query := range []string{"?limit=0", "?limit=101", "?limit=some", "?before=latest"} {
+		response := serveRouter(t, router, "GET", "/carts/"+cartID+"/history"+query, "", nil)
+		require.Equal(t, http.StatusBadRequest, response.Code, query)
+	}
+}
+
+func TestRouterReadsCartsAtVersionOrTime(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	response := serveRouterAs(t, router, "diner1", "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1}, "fries": {"diner2": 1}}}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	// the history is timestamped to the millisecond
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	response = serveRouterAs(t, router, "diner2", "DELETE", "/carts/"+cartID+"/items/fries", "")
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	for _, at := range []string{"1", url.QueryEscape(between.Format(time.RFC3339Nano))} {
+		var cart Cart
+		response = serveRouter(t, router, "GET", "/carts/"+cartID+"?at="+at, "", &cart)
+		require.Equal(t, http.StatusOK, response.Code, at)
+		require.Equal(t, `"1"`, response.Header().Get("ETag"), at)
+		require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1}, "fries": {"diner2": 1}}, cart.CartDetails, at)
+	}
+
+	var itemDetails ItemDetails
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/items/fries?at=1", "", &itemDetails)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, ItemDetails{"diner2": 1}, itemDetails)
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/items/fries?at=2", "", nil)
+	require.Equal(t, http.StatusNotFound, response.Code)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"?at=3", "", nil)
+	require.Equal(t, http.StatusNotFound, response.Code)
+	require.Equal(t, "application/problem+json", response.Header().Get("Content-Type"))
+
+	for _, at := range []string{"-1", "yesterday"} {
+		response = serveRouter(t, router, "GET", "/carts/"+cartID+"?at="+at, "", nil)
+		require.Equal(t, http.StatusBadRequest, response.Code, at)
+	}
+}
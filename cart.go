@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
 // TODO: define as you best see fit
 type ItemID string
 type DinerID string
@@ -7,10 +13,46 @@ type ItemDetails map[DinerID]int
 type Cart struct {
 	CartID      string                 `json:"cart_id"`
 	CartDetails map[ItemID]ItemDetails `json:"cart_details"`
+	// incremented by every write of the cart, 0 if it was never written,
+	// and served as its ETag rather than as part of it
+	Version int64 `json:"-"`
+	// when each quantity was last written, by the field it is stored
+	// under, for replicas of the cart to converge
+	clocks map[string]HLC
+}
+
+// CartLimits bound what a single cart may hold, so that
+// no payload can grow a cart beyond what a table could order
+type CartLimits struct {
+	// of an item for a single diner
+	MaxQuantity int
+	MaxItems    int
+	// across all items
+	MaxDiners int
+	// of the cart encoded as JSON
+	MaxBytes int
+}
+
+// limits of what a table orders together, two digit quantities and a
+// hundred items among fifty diners, with 64KiB of JSON being plenty for
+// that while keeping every read and write of a cart small
+func DefaultCartLimits() CartLimits {
+	return CartLimits{
+		MaxQuantity: 99,
+		MaxItems:    100,
+		MaxDiners:   50,
+		MaxBytes:    64 << 10,
+	}
+}
+
+func (l CartLimits) Validate() error {
+	if l.MaxQuantity <= 0 || l.MaxItems <= 0 || l.MaxDiners <= 0 || l.MaxBytes <= 0 {
+		return fmt.Errorf("cart limits must be positive")
+	}
+
+	return nil
 }
 
-// TODO: define domain level checks
-// such as validity of a Cart
 func NewCart(cartID string) Cart {
 	cart := Cart{
 		CartID:      cartID,
@@ -18,3 +60,65 @@ func NewCart(cartID string) Cart {
 	}
 	return cart
 }
+
+// Validate checks the cart against the limits, returning
+// a ValidationError that lists every field that violates them
+func (c Cart) Validate(limits CartLimits) error {
+	var fields []FieldError
+	if c.CartID == "" {
+		fields = append(fields, FieldError{Field: "cart_id", Message: "must not be empty"})
+	}
+
+	// in order so that violations are always reported in the same order
+	itemIDs := make([]string, 0, len(c.CartDetails))
+	for itemID := range c.CartDetails {
+		itemIDs = append(itemIDs, string(itemID))
+	}
+	sort.Strings(itemIDs)
+
+	diners := make(map[DinerID]bool)
+	for _, itemID := range itemIDs {
+		itemField := "cart_details." + itemID
+		if itemID == "" {
+			fields = append(fields, FieldError{Field: "cart_details", Message: "item IDs must not be empty"})
+		}
+
+		itemDetails := c.CartDetails[ItemID(itemID)]
+		dinerIDs := make([]string, 0, len(itemDetails))
+		for dinerID := range itemDetails {
+			dinerIDs = append(dinerIDs, string(dinerID))
+		}
+		sort.Strings(dinerIDs)
+
+		for _, dinerID := range dinerIDs {
+			diners[DinerID(dinerID)] = true
+			if dinerID == "" {
+				fields = append(fields, FieldError{Field: itemField, Message: "diner IDs must not be empty"})
+			}
+
+			quantity := itemDetails[DinerID(dinerID)]
+			if quantity < 0 {
+				fields = append(fields, FieldError{Field: itemField + "." + dinerID, Message: "must not be negative"})
+			}
+			if quantity > limits.MaxQuantity {
+				fields = append(fields, FieldError{Field: itemField + "." + dinerID, Message: fmt.Sprintf("must be at most %d", limits.MaxQuantity)})
+			}
+		}
+	}
+
+	if len(c.CartDetails) > limits.MaxItems {
+		fields = append(fields, FieldError{Field: "cart_details", Message: fmt.Sprintf("must have at most %d items", limits.MaxItems)})
+	}
+	if len(diners) > limits.MaxDiners {
+		fields = append(fields, FieldError{Field: "cart_details", Message: fmt.Sprintf("must have at most %d diners", limits.MaxDiners)})
+	}
+	if serializedData, err := json.Marshal(c); err == nil && len(serializedData) > limits.MaxBytes {
+		fields = append(fields, FieldError{Field: "", Message: fmt.Sprintf("must be at most %d bytes encoded as JSON", limits.MaxBytes)})
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+
+	return nil
+}
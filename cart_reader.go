@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/go-redis/redis/v8"
@@ -14,25 +14,28 @@ type CartReader interface {
 
 type RedisCartReader struct {
 	client *redis.Client
+	config RedisCartConfig
 }
 
-func NewRedisCartReader(client *redis.Client) *RedisCartReader {
+func NewRedisCartReader(client *redis.Client, options ...RedisCartOption) (*RedisCartReader, error) {
+	config, err := newRedisCartConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
 	return &RedisCartReader{
 		client: client,
-	}
+		config: config,
+	}, nil
 }
 
 func (r *RedisCartReader) ReadCartWithContext(ctx context.Context, cartID string) (Cart, error) {
-	serializedData, err := r.client.Get(ctx, cartID).Result()
-	if err != nil && err != redis.Nil {
-		return Cart{}, fmt.Errorf("error getting cart from redis: %w", err)
+	cart, _, err := r.config.loadCart(ctx, r.client, cartID)
+	if errors.Is(err, ErrCorruptCart) {
+		return Cart{}, fmt.Errorf("error unmarshaling cart from redis: %w", err)
 	}
-
-	cart := NewCart(cartID)
-	if err != redis.Nil {
-		if err := json.Unmarshal([]byte(serializedData), &cart); err != nil {
-			return Cart{}, fmt.Errorf("error unmarshaling cart from redis: %w", err)
-		}
+	if err != nil {
+		return Cart{}, fmt.Errorf("error getting cart from redis: %w", unavailable(ctx, err))
 	}
 
 	return cart, nil
@@ -12,7 +12,7 @@ import (
 
 func TestRedisReadCartWithContextReturnsErrorIfErrorRetrievingKeyFromRedis(t *testing.T) {
 	client := MustRedisTestClient()
-	reader := NewRedisCartReader(client)
+	reader := MustRedisCartReader(client)
 	cartID := uuid.NewV4().String()
 	_, err := client.LPush(context.Background(), cartID, "irrelevant").Result()
 	require.NoError(t, err)
@@ -28,7 +28,7 @@ func TestRedisReadCartWithContextReturnsErrorIfErrorRetrievingKeyFromRedis(t *te
 
 func TestRedisReadCartWithContextReturnsErrorIfReturnedDataIsNotJSONSerialized(t *testing.T) {
 	client := MustRedisTestClient()
-	reader := NewRedisCartReader(client)
+	reader := MustRedisCartReader(client)
 	cartID := uuid.NewV4().String()
 	_, err := client.Set(context.Background(), cartID, "totally not JSON", 100*time.Millisecond).Result()
 	require.NoError(t, err)
@@ -41,7 +41,7 @@ func TestRedisReadCartWithContextReturnsErrorIfReturnedDataIsNotJSONSerialized(t
 
 func TestRedisReadCartWithContextReturnsErrorIfReturnedDataIsInvalidJSON(t *testing.T) {
 	client := MustRedisTestClient()
-	reader := NewRedisCartReader(client)
+	reader := MustRedisCartReader(client)
 	cartID := uuid.NewV4().String()
 	// cart_id should be string
 	_, err := client.Set(context.Background(), cartID, `{"cart_id": 1}`, 100*time.Millisecond).Result()
@@ -55,9 +55,10 @@ func TestRedisReadCartWithContextReturnsErrorIfReturnedDataIsInvalidJSON(t *test
 
 func TestRedisReadCartWithContextReturnsErrorIfContextHasExpired(t *testing.T) {
 	client := MustRedisTestClient()
-	reader := NewRedisCartReader(client)
+	reader := MustRedisCartReader(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 0*time.Second)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 0*time.Second)
+	defer cancelFunc()
 	_, err := client.Set(context.Background(), cartID, `"valid JSON"`, 100*time.Millisecond).Result()
 	require.NoError(t, err)
 
@@ -68,7 +69,7 @@ func TestRedisReadCartWithContextReturnsErrorIfContextHasExpired(t *testing.T) {
 }
 
 func TestRedisReadCartWithContextReturnsAnEmptyCartIfNotPresent(t *testing.T) {
-	reader := NewRedisCartReader(MustRedisTestClient())
+	reader := MustRedisCartReader(MustRedisTestClient())
 	cartID := uuid.NewV4().String()
 
 	cart, err := reader.ReadCartWithContext(context.Background(), cartID)
@@ -80,9 +81,10 @@ func TestRedisReadCartWithContextReturnsAnEmptyCartIfNotPresent(t *testing.T) {
 
 func TestRedisReadCartWithContextReturnsSavedCartIfPresentAndValidJSON(t *testing.T) {
 	client := MustRedisTestClient()
-	reader := NewRedisCartReader(client)
+	reader := MustRedisCartReader(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 100*time.Second)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancelFunc()
 	_, err := client.Set(
 		context.Background(),
 		cartID,
@@ -97,3 +99,32 @@ func TestRedisReadCartWithContextReturnsSavedCartIfPresentAndValidJSON(t *testin
 	require.Equal(t, cartID, cart.CartID)
 	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
 }
+
+func TestRedisReadCartWithContextReturnsSavedCartIfPresentAsHash(t *testing.T) {
+	client := MustRedisTestClient()
+	reader := MustRedisCartReader(client)
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}}}, false)
+
+	cart, err := reader.ReadCartWithContext(context.Background(), cartID)
+
+	require.NoError(t, err)
+	require.Equal(t, cartID, cart.CartID)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}}, cart.CartDetails)
+}
+
+func TestRedisReadCartWithContextReturnsErrorIfHashFieldIsCorrupt(t *testing.T) {
+	client := MustRedisTestClient()
+	reader := MustRedisCartReader(client)
+	cartID := uuid.NewV4().String()
+	_, err := client.HSet(context.Background(), cartID, cartField("food", "diner"), "lots").Result()
+	require.NoError(t, err)
+	defer func() {
+		client.Del(context.Background(), cartID).Result()
+	}()
+
+	_, err = reader.ReadCartWithContext(context.Background(), cartID)
+
+	require.Error(t, err)
+	require.Regexp(t, "error unmarshaling cart", err.Error())
+}
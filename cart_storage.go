@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// carts are stored as hashes with a field per (ItemID, DinerID) holding
+// its quantity, so that updates only touch the fields that changed,
+// whereas legacy carts were stored as a single JSON blob of the Cart
+// that is still read transparently and rewritten as a hash on update
+//
+// an item with no diners cannot be represented as a hash and is dropped
+//
+// alongside every cart is a hash of the clock each field was last written
+// at, removed fields included, plus the latest clock written to the cart,
+// and a counter of its writes which lives on when the cart is emptied so
+// that a version is not reused for different contents of the cart while
+// it lives, though it expires along with the cart, after which a cart by
+// the same ID starts over from version 1 and ETags of the expired one may
+// match it
+
+// ErrCorruptCart distinguishes carts that are stored but cannot be
+// decoded from failures to retrieve them in the first place
+var ErrCorruptCart = errors.New("corrupt cart")
+
+type cartGetter interface {
+	Get(context.Context, string) *redis.StringCmd
+	HGetAll(context.Context, string) *redis.StringStringMapCmd
+	Pipelined(context.Context, func(redis.Pipeliner) error) ([]redis.Cmder, error)
+}
+
+// the field of the clocks of a cart that is not the clock of a field
+const latestClockField = "latest"
+
+func cartClocks(cartKey string) string {
+	return fmt.Sprintf("%s:%s", cartKey, "clocks")
+}
+
+func cartVersion(cartKey string) string {
+	return fmt.Sprintf("%s:%s", cartKey, "version")
+}
+
+// the fields and clocks of a cart as loaded, since updater
+// functions are free to modify the cart they are given
+type cartSnapshot struct {
+	fields map[string]int
+	clocks map[string]HLC
+}
+
+func snapshotCart(cart *Cart) cartSnapshot {
+	clocks := make(map[string]HLC, len(cart.clocks))
+	for field, clock := range cart.clocks {
+		clocks[field] = clock
+	}
+
+	return cartSnapshot{fields: cartFields(cart), clocks: clocks}
+}
+
+// encoded as a JSON array so that no ItemID or DinerID can produce
+// an ambiguous field or one that collides with a metadata field
+func cartField(itemID ItemID, dinerID DinerID) string {
+	// marshaling strings cannot fail
+	field, _ := json.Marshal([2]string{string(itemID), string(dinerID)})
+	return string(field)
+}
+
+// the prefix shared by the fields of every diner of the item
+func cartItemFieldPrefix(itemID ItemID) string {
+	field, _ := json.Marshal([1]string{string(itemID)})
+	return strings.TrimSuffix(string(field), "]") + ","
+}
+
+// fields that are not JSON arrays are reserved for metadata
+func isCartField(field string) bool {
+	return strings.HasPrefix(field, "[")
+}
+
+func parseCartField(field string) (ItemID, DinerID, error) {
+	var ids [2]string
+	if err := json.Unmarshal([]byte(field), &ids); err != nil {
+		return "", "", fmt.Errorf("invalid cart field %q: %w", field, err)
+	}
+
+	return ItemID(ids[0]), DinerID(ids[1]), nil
+}
+
+func cartFields(cart *Cart) map[string]int {
+	fields := make(map[string]int)
+	for itemID, itemDetails := range cart.CartDetails {
+		for dinerID, quantity := range itemDetails {
+			fields[cartField(itemID, dinerID)] = quantity
+		}
+	}
+
+	return fields
+}
+
+func cartFromFields(cartID string, fields map[string]string) (Cart, error) {
+	cart := NewCart(cartID)
+	for field, value := range fields {
+		if !isCartField(field) {
+			continue
+		}
+
+		itemID, dinerID, err := parseCartField(field)
+		if err != nil {
+			return Cart{}, fmt.Errorf("%w: %v", ErrCorruptCart, err)
+		}
+		quantity, err := strconv.Atoi(value)
+		if err != nil {
+			return Cart{}, fmt.Errorf("%w: invalid quantity for field %q: %v", ErrCorruptCart, field, err)
+		}
+
+		if _, ok := cart.CartDetails[itemID]; !ok {
+			cart.CartDetails[itemID] = make(ItemDetails)
+		}
+		cart.CartDetails[itemID][dinerID] = quantity
+	}
+
+	return cart, nil
+}
+
+func clocksFromFields(fields map[string]string) (map[string]HLC, error) {
+	clocks := make(map[string]HLC, len(fields))
+	for field, value := range fields {
+		clock, err := parseHLC(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptCart, err)
+		}
+		clocks[field] = clock
+	}
+
+	return clocks, nil
+}
+
+// loads the cart in whichever layout it is stored, reporting whether
+// that is the legacy layout, with decoding errors wrapping ErrCorruptCart
+func (c RedisCartConfig) loadCart(ctx context.Context, getter cartGetter, cartID string) (Cart, bool, error) {
+	// the errors of the pipeline are those of its commands
+	var fieldsCmd, clocksCmd *redis.StringStringMapCmd
+	var versionCmd *redis.StringCmd
+	_, _ = getter.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		fieldsCmd = pipe.HGetAll(ctx, c.cartKey(cartID))
+		clocksCmd = pipe.HGetAll(ctx, cartClocks(c.cartKey(cartID)))
+		versionCmd = pipe.Get(ctx, cartVersion(c.cartKey(cartID)))
+
+		return nil
+	})
+
+	version, err := versionCmd.Int64()
+	if err != nil && err != redis.Nil {
+		if _, ok := err.(*strconv.NumError); ok {
+			return Cart{}, false, fmt.Errorf("%w: invalid version: %v", ErrCorruptCart, err)
+		}
+		return Cart{}, false, err
+	}
+
+	fields, err := fieldsCmd.Result()
+	if err == nil {
+		clockFields, err := clocksCmd.Result()
+		if err != nil {
+			return Cart{}, false, err
+		}
+		cart, err := cartFromFields(cartID, fields)
+		if err != nil {
+			return Cart{}, false, err
+		}
+		cart.Version = version
+		cart.clocks, err = clocksFromFields(clockFields)
+		return cart, false, err
+	}
+	if !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return Cart{}, false, err
+	}
+
+	// the cart may have expired in between
+	serializedData, err := getter.Get(ctx, c.cartKey(cartID)).Result()
+	if err == redis.Nil {
+		return NewCart(cartID), false, nil
+	}
+	if err != nil {
+		return Cart{}, false, err
+	}
+
+	cart := NewCart(cartID)
+	if err := c.Serializer.Unmarshal([]byte(serializedData), &cart); err != nil {
+		return Cart{}, false, fmt.Errorf("%w: %v", ErrCorruptCart, err)
+	}
+	cart.Version = version
+
+	return cart, true, nil
+}
+
+// queues the commands turning the stored fields into those of the updated
+// cart, rewriting the cart as a whole only if it needs migrating, and
+// stamping every field that changed with a new clock unless the updated
+// cart carries the clock it was changed at, as merged carts do, and logging
+// the quantities that changed as well as recording them in the history of the
+// cart, returning the command that gives the version of the cart once written
+func (c RedisCartConfig) queueCartWrite(ctx context.Context, pipe redis.Pipeliner, cartID string, stored cartSnapshot, legacy bool, updatedCart *Cart) *redis.IntCmd {
+	cartKey := c.cartKey(cartID)
+	updatedFields := cartFields(updatedCart)
+	changes := quantityChanges(stored.fields, updatedFields)
+	if legacy {
+		pipe.Del(ctx, cartKey)
+		stored.fields = nil
+	}
+
+	latest := stored.clocks[latestClockField]
+	for _, clock := range updatedCart.clocks {
+		if latest.Before(clock) {
+			latest = clock
+		}
+	}
+	stamp := nextHLC(latest, c.Clock(), c.ReplicaID)
+
+	changedClocks := make([]interface{}, 0)
+	changedClock := func(field string, changed bool) {
+		clock, ok := updatedCart.clocks[field]
+		if storedClock, wasStored := stored.clocks[field]; ok && (!wasStored || storedClock != clock) {
+			changedClocks = append(changedClocks, field, clock.String())
+			return
+		}
+		if changed {
+			changedClocks = append(changedClocks, field, stamp.String())
+			latest = stamp
+		}
+	}
+
+	changedFields := make([]interface{}, 0, 2*len(updatedFields))
+	for field, quantity := range updatedFields {
+		storedQuantity, ok := stored.fields[field]
+		if !ok || storedQuantity != quantity {
+			changedFields = append(changedFields, field, quantity)
+		}
+		changedClock(field, !ok || storedQuantity != quantity)
+	}
+	if len(changedFields) > 0 {
+		pipe.HSet(ctx, cartKey, changedFields...)
+	}
+
+	removedFields := make([]string, 0)
+	for field := range stored.fields {
+		if _, ok := updatedFields[field]; !ok {
+			removedFields = append(removedFields, field)
+			changedClock(field, true)
+		}
+	}
+	if len(removedFields) > 0 {
+		pipe.HDel(ctx, cartKey, removedFields...)
+	}
+
+	// fields removed before they were merged in
+	for field := range updatedCart.clocks {
+		_, isUpdated := updatedFields[field]
+		_, wasStored := stored.fields[field]
+		if isCartField(field) && !isUpdated && !wasStored {
+			changedClock(field, false)
+		}
+	}
+
+	if len(changedClocks) > 0 {
+		changedClocks = append(changedClocks, latestClockField, latest.String())
+		pipe.HSet(ctx, cartClocks(cartKey), changedClocks...)
+	}
+
+	version := pipe.Incr(ctx, cartVersion(cartKey))
+	c.queueChangeLog(ctx, pipe, cartID, changes)
+	c.queueHistory(ctx, pipe, cartID, changes)
+	pipe.Expire(ctx, cartKey, c.CartTTL)
+	pipe.Expire(ctx, cartClocks(cartKey), c.CartTTL)
+	pipe.Expire(ctx, cartVersion(cartKey), c.CartTTL)
+
+	return version
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCartFieldRoundTripsAnyItemAndDinerIDs(t *testing.T) {
+	for _, ids := range [][2]string{
+		{"food", "diner"},
+		{"food:with:colons", "diner"},
+		{`food","diner`, ""},
+		{"[food]", "{diner}"},
+	} {
+		itemID, dinerID, err := parseCartField(cartField(ItemID(ids[0]), DinerID(ids[1])))
+
+		require.NoError(t, err)
+		require.Equal(t, ItemID(ids[0]), itemID)
+		require.Equal(t, DinerID(ids[1]), dinerID)
+		require.True(t, isCartField(cartField(ItemID(ids[0]), DinerID(ids[1]))))
+	}
+}
+
+func TestCartFromFieldsSkipsMetadataFields(t *testing.T) {
+	cart, err := cartFromFields("cart", map[string]string{
+		cartField("food", "diner"): "2",
+		"metadata":                 "irrelevant",
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 2}}, cart.CartDetails)
+}
+
+func TestCartFromFieldsReturnsErrCorruptCartIfQuantityIsNotAnInteger(t *testing.T) {
+	_, err := cartFromFields("cart", map[string]string{
+		cartField("food", "diner"): "lots",
+	})
+
+	require.ErrorIs(t, err, ErrCorruptCart)
+}
+
+func TestCartFromFieldsReturnsErrCorruptCartIfFieldIsNotAPair(t *testing.T) {
+	_, err := cartFromFields("cart", map[string]string{
+		`["food"`: "1",
+	})
+
+	require.ErrorIs(t, err, ErrCorruptCart)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCartValidateAcceptsCartsWithinLimits(t *testing.T) {
+	cart := NewCart("cart")
+	require.NoError(t, cart.Validate(DefaultCartLimits()))
+
+	cart.CartDetails["food"] = ItemDetails{"diner1": 0, "diner2": DefaultCartLimits().MaxQuantity}
+	require.NoError(t, cart.Validate(DefaultCartLimits()))
+}
+
+func TestCartValidateRejectsCartsViolatingLimits(t *testing.T) {
+	limits := CartLimits{MaxQuantity: 5, MaxItems: 2, MaxDiners: 2, MaxBytes: 100}
+
+	for _, testCase := range []struct {
+		name     string
+		cart     Cart
+		expected []FieldError
+	}{
+		{
+			name:     "empty cart ID",
+			cart:     NewCart(""),
+			expected: []FieldError{{Field: "cart_id", Message: "must not be empty"}},
+		},
+		{
+			name:     "empty item ID",
+			cart:     Cart{CartID: "cart", CartDetails: map[ItemID]ItemDetails{"": {"diner": 1}}},
+			expected: []FieldError{{Field: "cart_details", Message: "item IDs must not be empty"}},
+		},
+		{
+			name:     "empty diner ID",
+			cart:     Cart{CartID: "cart", CartDetails: map[ItemID]ItemDetails{"food": {"": 1}}},
+			expected: []FieldError{{Field: "cart_details.food", Message: "diner IDs must not be empty"}},
+		},
+		{
+			name:     "negative quantity",
+			cart:     Cart{CartID: "cart", CartDetails: map[ItemID]ItemDetails{"food": {"diner": -1}}},
+			expected: []FieldError{{Field: "cart_details.food.diner", Message: "must not be negative"}},
+		},
+		{
+			name:     "quantity over max",
+			cart:     Cart{CartID: "cart", CartDetails: map[ItemID]ItemDetails{"food": {"diner": 6}}},
+			expected: []FieldError{{Field: "cart_details.food.diner", Message: "must be at most 5"}},
+		},
+		{
+			name:     "too many items",
+			cart:     Cart{CartID: "cart", CartDetails: map[ItemID]ItemDetails{"a": {"diner": 1}, "b": {"diner": 1}, "c": {"diner": 1}}},
+			expected: []FieldError{{Field: "cart_details", Message: "must have at most 2 items"}},
+		},
+		{
+			name:     "too many diners",
+			cart:     Cart{CartID: "cart", CartDetails: map[ItemID]ItemDetails{"a": {"x": 1, "y": 1}, "b": {"z": 1}}},
+			expected: []FieldError{{Field: "cart_details", Message: "must have at most 2 diners"}},
+		},
+		{
+			name:     "too many bytes",
+			cart:     Cart{CartID: strings.Repeat("c", 100)},
+			expected: []FieldError{{Field: "", Message: "must be at most 100 bytes encoded as JSON"}},
+		},
+		{
+			name: "several violations",
+			cart: Cart{CartID: "", CartDetails: map[ItemID]ItemDetails{"b": {"diner": -1}, "a": {"diner": 6, "": 1}}},
+			expected: []FieldError{
+				{Field: "cart_id", Message: "must not be empty"},
+				{Field: "cart_details.a", Message: "diner IDs must not be empty"},
+				{Field: "cart_details.a.diner", Message: "must be at most 5"},
+				{Field: "cart_details.b.diner", Message: "must not be negative"},
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.cart.Validate(limits)
+
+			require.True(t, errors.Is(err, ErrValidation))
+			var validationErr *ValidationError
+			require.True(t, errors.As(err, &validationErr))
+			require.Equal(t, testCase.expected, validationErr.Fields)
+		})
+	}
+}
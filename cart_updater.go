@@ -2,102 +2,528 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
 )
 
-// TODO: define as you best see fit
-const (
-	semaphoreToken          = 1
-	cartExpiry              = 5 * time.Minute
-	blockingSemaphoreExpiry = 1 * time.Second
-)
+// pushed to wake up waiters, its value is irrelevant
+const semaphoreToken = 1
+
+// ErrLockLost is returned when the cart lock is no longer held
+// by the updater that acquired it by the time it commits
+var ErrLockLost = errors.New("lock no longer held by updater")
+
+// ErrStaleFencingToken is returned when a newer lock holder has already
+// committed to the cart, so that a holder whose lease expired while
+// it was paused can never overwrite the newer cart
+var ErrStaleFencingToken = errors.New("fencing token older than last committed")
+
+// deletes the lock only if it is still held by the given owner token
+// and wakes up any waiters blocked on the cart
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("DEL", KEYS[2])
+redis.call("LPUSH", KEYS[2], ARGV[2])
+redis.call("PEXPIRE", KEYS[2], ARGV[3])
+return 1
+`)
+
+// waiters queue for the lock in ticket order and only the waiter at the
+// head of the queue may take it, so that the lock is handed off in arrival
+// order; waiters past their deadline are evicted in case they died waiting
+var acquireLockScript = redis.NewScript(`
+local expired = redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", ARGV[4])
+for _, waiter in ipairs(expired) do
+	redis.call("ZREM", KEYS[2], waiter)
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", ARGV[4])
+
+if not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	redis.call("ZADD", KEYS[2], redis.call("INCR", KEYS[4]), ARGV[1])
+end
+redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+for index = 2, 4 do
+	redis.call("PEXPIRE", KEYS[index], ARGV[5])
+end
+
+local head = redis.call("ZRANGE", KEYS[2], 0, 0)[1]
+if head ~= ARGV[1] or not redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return {0, head}
+end
+
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("DEL", KEYS[5])
+return {1, redis.call("ZRANGE", KEYS[2], 0, 0)[1] or ""}
+`)
+
+// removes a waiter from the queue, returning the waiter at the head
+// of the queue if it changed so that it can be woken up
+var leaveQueueScript = redis.NewScript(`
+local head = redis.call("ZRANGE", KEYS[1], 0, 0)[1]
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+if head ~= ARGV[1] then
+	return ""
+end
+return redis.call("ZRANGE", KEYS[1], 0, 0)[1] or ""
+`)
 
+// extends the lock only if it is still held by the given owner token
+var extendLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`)
+
+// ErrUpdateAborted is returned when updaterFunc returns a nil cart,
+// which leaves the cart as it was without saving anything
+var ErrUpdateAborted = errors.New("update aborted by updater")
+
+// CartUpdater updates carts, setting the version of the updated cart once
+// saved, and only if it is still at the given version when conditional
 type CartUpdater interface {
 	UpdateCartWithContext(context.Context, string, func(*Cart) *Cart) error
+	UpdateCartIfVersionWithContext(context.Context, string, int64, func(*Cart) *Cart) error
+}
+
+// the version of unconditional updates, which no cart is ever at
+const anyVersion int64 = -1
+
+type UpdateStrategy string
+
+const (
+	// serializes updates of a cart behind a lock
+	LockingUpdateStrategy UpdateStrategy = "locking"
+	// lets updates of a cart race and retries those that lose
+	OptimisticUpdateStrategy UpdateStrategy = "optimistic"
+	// merges updates of a cart in a single script, without locks or
+	// retries, and lets every other update race as optimistic ones do
+	ScriptUpdateStrategy UpdateStrategy = "script"
+)
+
+func NewCartUpdater(client *redis.Client, strategy UpdateStrategy, options ...RedisCartOption) (CartUpdater, error) {
+	switch strategy {
+	case LockingUpdateStrategy:
+		updater, err := NewRedisCartUpdater(client, options...)
+		if err != nil {
+			return nil, err
+		}
+		return updater, nil
+	case OptimisticUpdateStrategy:
+		updater, err := NewRedisOptimisticCartUpdater(client, options...)
+		if err != nil {
+			return nil, err
+		}
+		return updater, nil
+	case ScriptUpdateStrategy:
+		updater, err := NewRedisScriptCartUpdater(client, options...)
+		if err != nil {
+			return nil, err
+		}
+		return updater, nil
+	default:
+		return nil, fmt.Errorf("unknown update strategy %q", strategy)
+	}
 }
 
 type RedisCartUpdater struct {
 	client *redis.Client
+	config RedisCartConfig
+
+	// cart keys of the locks currently held, by owner token,
+	// so that they can all be released on shutdown
+	heldLocksMutex sync.Mutex
+	heldLocks      map[string]string
 }
 
-func NewRedisCartUpdater(client *redis.Client) *RedisCartUpdater {
-	return &RedisCartUpdater{
-		client: client,
+func NewRedisCartUpdater(client *redis.Client, options ...RedisCartOption) (*RedisCartUpdater, error) {
+	config, err := newRedisCartConfig(options)
+	if err != nil {
+		return nil, err
 	}
+
+	return &RedisCartUpdater{
+		client:    client,
+		config:    config,
+		heldLocks: make(map[string]string),
+	}, nil
 }
 
 func (r *RedisCartUpdater) UpdateCartWithContext(ctx context.Context, cartID string, updaterFunc func(*Cart) *Cart) error {
-	for {
-		// ok to ignore because ctx will expire in call anyway
-		deadline, _ := ctx.Deadline()
-		ok, err := r.client.SetNX(ctx, lockingSemaphore(cartID), semaphoreToken, deadline.Sub(time.Now())).Result()
+	return r.updateCart(ctx, cartID, anyVersion, updaterFunc)
+}
+
+// UpdateCartIfVersionWithContext fails with ErrVersionMismatch if the cart
+// is not at the given version once locked, without calling updaterFunc
+func (r *RedisCartUpdater) UpdateCartIfVersionWithContext(ctx context.Context, cartID string, version int64, updaterFunc func(*Cart) *Cart) error {
+	return r.updateCart(ctx, cartID, version, updaterFunc)
+}
+
+func (r *RedisCartUpdater) updateCart(ctx context.Context, cartID string, version int64, updaterFunc func(*Cart) *Cart) error {
+	// unique per acquisition so that we can never release
+	// or extend a lock that has since been acquired by another updater
+	token := uuid.NewV4().String()
+	if err := r.acquireLock(ctx, r.config.cartKey(cartID), token); err != nil {
+		return err
+	}
+	r.holdLock(r.config.cartKey(cartID), token)
+	defer r.dropLock(token)
+
+	if r.config.LockLease <= 0 {
+		return r.updateLockedCart(ctx, cartID, token, version, updaterFunc)
+	}
+
+	stopRenewingLease := r.renewLease(ctx, r.config.cartKey(cartID), token)
+	err := r.updateLockedCart(ctx, cartID, token, version, updaterFunc)
+	// the lease also appears lost once a successful commit deletes the lock,
+	// or once an update that failed for another reason released it, so only
+	// the commit being refused is put down to the lease
+	leaseLost := stopRenewingLease()
+	if leaseLost && (errors.Is(err, ErrLockLost) || errors.Is(err, ErrStaleFencingToken)) {
+		return fmt.Errorf("lease on lock lost during update: %w", ErrLockLost)
+	}
+
+	return err
+}
+
+func (r *RedisCartUpdater) updateLockedCart(ctx context.Context, cartID string, token string, version int64, updaterFunc func(*Cart) *Cart) error {
+	cartKey := r.config.cartKey(cartID)
+
+	// fencing tokens increase monotonically across acquisitions and
+	// the counter lives as long as the cart so it never resets under it
+	var fence *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		fence = pipe.Incr(ctx, fencingTokenCounter(cartKey))
+		pipe.Expire(ctx, fencingTokenCounter(cartKey), r.config.CartTTL)
+
+		return nil
+	})
+	if err != nil {
+		r.releaseLock(cartKey, token)
+		return fmt.Errorf("error acquiring lock for update: %w", unavailable(ctx, err))
+	}
+
+	cart, legacy, err := r.config.loadCart(ctx, r.client, cartID)
+	if err != nil {
+		r.releaseLock(cartKey, token)
+		if errors.Is(err, ErrCorruptCart) {
+			return fmt.Errorf("error unmarshaling existing cart from redis: %w", err)
+		}
+		return fmt.Errorf("error getting existing cart from redis: %w", unavailable(ctx, err))
+	}
+	if version != anyVersion && cart.Version != version {
+		r.releaseLock(cartKey, token)
+		return fmt.Errorf("error updating cart at version %d: %w", cart.Version, ErrVersionMismatch)
+	}
+
+	stored := snapshotCart(&cart)
+	updatedCart := updaterFunc(&cart)
+	if updatedCart == nil {
+		r.releaseLock(cartKey, token)
+		return fmt.Errorf("error updating cart: %w", ErrUpdateAborted)
+	}
+	if err := updatedCart.Validate(r.config.Limits); err != nil {
+		r.releaseLock(cartKey, token)
+		return fmt.Errorf("error updating cart: %w", err)
+	}
+
+	// watching the lock and the last committed fencing token means that
+	// the transaction is discarded if either changes between the checks and exec
+	var savedVersion *redis.IntCmd
+	err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+		committedFence, err := tx.Get(ctx, committedFencingToken(cartKey)).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if committedFence >= fence.Val() {
+			return ErrStaleFencingToken
+		}
+
+		owner, err := tx.Get(ctx, lockingSemaphore(cartKey)).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if owner != token {
+			return ErrLockLost
+		}
+
+		cmdErrs, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			savedVersion = r.config.queueCartWrite(ctx, pipe, cartID, stored, legacy, updatedCart)
+			pipe.Set(ctx, committedFencingToken(cartKey), fence.Val(), r.config.CartTTL)
+			pipe.Expire(ctx, fencingTokenCounter(cartKey), r.config.CartTTL)
+			pipe.Del(ctx, blockingSemaphore(cartKey))
+			pipe.LPush(ctx, blockingSemaphore(cartKey), semaphoreToken)
+			pipe.Expire(ctx, blockingSemaphore(cartKey), r.config.WakeUpInterval)
+			pipe.Del(ctx, lockingSemaphore(cartKey))
+
+			return nil
+		})
+		if err == redis.TxFailedErr {
+			return ErrLockLost
+		}
 		if err != nil {
-			return fmt.Errorf("error acquiring lock for update: %w", err)
+			return err
 		}
 
-		if !ok {
-			_, err := r.client.BLPop(ctx, 0, blockingSemaphore(cartID)).Result()
-			if err != nil {
-				return fmt.Errorf("timed out waiting for lock for update: %w", err)
+		for index := range cmdErrs {
+			if cmdErrs[index].Err() != nil {
+				return cmdErrs[index].Err()
 			}
-
-			continue
 		}
 
-		break
-	}
+		return nil
+	}, lockingSemaphore(cartKey), committedFencingToken(cartKey))
 
-	_, err := r.client.Del(ctx, blockingSemaphore(cartID)).Result()
 	if err != nil {
-		return fmt.Errorf("error acquiring lock for update: %w", err)
+		if !errors.Is(err, ErrLockLost) {
+			r.releaseLock(cartKey, token)
+		}
+		return fmt.Errorf("error saving cart in redis: %w", unavailable(ctx, err))
 	}
+	updatedCart.Version = savedVersion.Val()
+
+	// watchers catch up on the next event or when they resume,
+	// so failing to publish does not fail an update that was saved
+	_ = r.config.publishCart(ctx, r.client, cartID, updatedCart)
 
-	cart := NewCart(cartID)
-	serializedData, err := r.client.Get(ctx, cartID).Result()
-	if err != nil && err != redis.Nil {
-		return fmt.Errorf("error getting existing cart from redis: %w", err)
+	return nil
+}
+
+// waits in the queue of the cart until the lock is handed to token
+func (r *RedisCartUpdater) acquireLock(ctx context.Context, cartKey string, token string) error {
+	// without a deadline the lock is held for the default TTL
+	// and we only wait for it for up to the maximum wait
+	_, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		var cancelFunc context.CancelFunc
+		ctx, cancelFunc = context.WithTimeout(ctx, r.config.MaxWait)
+		defer cancelFunc()
 	}
-	if err != redis.Nil {
-		if err := json.Unmarshal([]byte(serializedData), &cart); err != nil {
-			return fmt.Errorf("error unmarshaling existing cart from redis: %w", err)
+	deadline, _ := ctx.Deadline()
+
+	for {
+		// the deadline is relative to the clock of the context whereas
+		// the times stored in redis are relative to the configured clock
+		remaining := time.Until(deadline)
+		now := r.config.Clock()
+		reply, err := acquireLockScript.Run(
+			ctx,
+			r.client,
+			[]string{
+				lockingSemaphore(cartKey),
+				waitingQueue(cartKey),
+				waitingDeadlines(cartKey),
+				waitingTicketCounter(cartKey),
+				blockingSemaphore(cartKey),
+			},
+			token,
+			r.lockTTL(remaining, hasDeadline).Milliseconds(),
+			now.Add(remaining).UnixNano()/int64(time.Millisecond),
+			now.UnixNano()/int64(time.Millisecond),
+			r.config.CartTTL.Milliseconds(),
+		).Result()
+		if err != nil {
+			r.leaveQueue(cartKey, token)
+			if ctx.Err() != nil {
+				return fmt.Errorf("timed out waiting for lock for update: %w", lockTimeout(err))
+			}
+			return fmt.Errorf("error acquiring lock for update: %w", unavailable(ctx, err))
+		}
+
+		// replies with whether the lock was acquired and the head of the queue
+		values, _ := reply.([]interface{})
+		acquired := len(values) == 2 && values[0] == int64(1)
+		head := ""
+		if len(values) == 2 {
+			head, _ = values[1].(string)
+		}
+
+		if acquired {
+			// the next in line waits on the lock itself from now on
+			if head != "" {
+				r.wakeWaiter(ctx, cartKey, head)
+			}
+
+			return nil
+		}
+
+		// only the head of the queue waits on the lock being released, the
+		// rest wait on their turn, and both retry in case a wake up was lost
+		semaphore := waitingSemaphore(cartKey, token)
+		if head == token {
+			semaphore = blockingSemaphore(cartKey)
+		}
+		_, err = r.client.BLPop(ctx, r.config.WakeUpInterval, semaphore).Result()
+		if err != nil && err != redis.Nil {
+			r.leaveQueue(cartKey, token)
+			if ctx.Err() != nil {
+				return fmt.Errorf("timed out waiting for lock for update: %w", lockTimeout(err))
+			}
+			return fmt.Errorf("error waiting for lock for update: %w", unavailable(ctx, err))
 		}
 	}
+}
 
-	// as implemented the cart cannot failing marshaling
-	// and so cannot be tested easily without hacks and
-	// so we will not test this error path
-	updatedCartJSON, err := json.Marshal(updaterFunc(&cart))
-	if err != nil {
-		return fmt.Errorf("error marshaling cart for redis: %w", err)
+// dequeues a waiter that gave up, on a context of its own for the same
+// reasons as releaseLock, handing its turn over if it was next in line
+func (r *RedisCartUpdater) leaveQueue(cartKey string, token string) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.config.LockReleaseTimeout)
+	defer cancelFunc()
+
+	head, err := leaveQueueScript.Run(
+		ctx,
+		r.client,
+		[]string{waitingQueue(cartKey), waitingDeadlines(cartKey)},
+		token,
+	).Text()
+	if err == nil && head != "" {
+		r.wakeWaiter(ctx, cartKey, head)
 	}
+}
 
-	cmdErrs, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.Set(ctx, cartID, updatedCartJSON, cartExpiry).Result()
-		pipe.Del(ctx, blockingSemaphore(cartID)).Result()
-		pipe.LPush(ctx, blockingSemaphore(cartID), semaphoreToken)
-		pipe.Expire(ctx, blockingSemaphore(cartID), blockingSemaphoreExpiry)
-		pipe.Del(ctx, lockingSemaphore(cartID))
+// best effort since waiters retry periodically anyway
+func (r *RedisCartUpdater) wakeWaiter(ctx context.Context, cartKey string, token string) {
+	r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, waitingSemaphore(cartKey, token), semaphoreToken)
+		pipe.Expire(ctx, waitingSemaphore(cartKey, token), r.config.WakeUpInterval)
 
 		return nil
 	})
+}
 
-	if err != nil {
-		return fmt.Errorf("error saving cart in redis: %w", err)
+func (r *RedisCartUpdater) lockTTL(remaining time.Duration, hasDeadline bool) time.Duration {
+	if r.config.LockLease > 0 {
+		return r.config.LockLease
 	}
+	if !hasDeadline {
+		return r.config.DefaultLockTTL
+	}
+
+	return remaining
+}
+
+// extends the lease on the lock a few times per lease until stopped
+// or until the lease turns out to have been lost, which it reports on
+// stopping, so that the commit is refused rather than the update cut short
+func (r *RedisCartUpdater) renewLease(ctx context.Context, cartKey string, token string) func() bool {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	lost := false
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(r.config.LockLease / 3)
+		defer ticker.Stop()
 
-	for index := range cmdErrs {
-		if cmdErrs[index].Err() != nil {
-			return fmt.Errorf("error saving cart in redis: %w", cmdErrs[index].Err())
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// errors are retried on the next tick, which is still within the lease
+				extended, err := r.extendLock(ctx, cartKey, token, r.config.LockLease)
+				if err == nil && !extended {
+					lost = true
+					return
+				}
+			}
 		}
+	}()
+
+	return func() bool {
+		close(stop)
+		<-done
+		return lost
+	}
+}
+
+func (r *RedisCartUpdater) holdLock(cartKey string, token string) {
+	r.heldLocksMutex.Lock()
+	defer r.heldLocksMutex.Unlock()
+
+	r.heldLocks[token] = cartKey
+}
+
+func (r *RedisCartUpdater) dropLock(token string) {
+	r.heldLocksMutex.Lock()
+	defer r.heldLocksMutex.Unlock()
+
+	delete(r.heldLocks, token)
+}
+
+// ReleaseLocks releases every lock held by updates still in progress so
+// that waiters on other instances need not wait out their TTLs, which
+// refuses the commits of those updates with ErrLockLost
+func (r *RedisCartUpdater) ReleaseLocks() error {
+	r.heldLocksMutex.Lock()
+	heldLocks := make(map[string]string, len(r.heldLocks))
+	for token, cartKey := range r.heldLocks {
+		heldLocks[token] = cartKey
+	}
+	r.heldLocksMutex.Unlock()
+
+	var errs []string
+	for token, cartKey := range heldLocks {
+		if err := r.releaseLock(cartKey, token); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error releasing held locks: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// releases the lock if still held by token, on a context of its own
+// since the context of the update may well be the reason for releasing
+func (r *RedisCartUpdater) releaseLock(cartKey string, token string) error {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), r.config.LockReleaseTimeout)
+	defer cancelFunc()
+
+	err := releaseLockScript.Run(
+		ctx,
+		r.client,
+		[]string{lockingSemaphore(cartKey), blockingSemaphore(cartKey)},
+		token,
+		semaphoreToken,
+		r.config.WakeUpInterval.Milliseconds(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("error releasing lock: %w", err)
 	}
 
 	return nil
 }
 
+// extends the lock by ttl if still held by token, reporting whether it was
+func (r *RedisCartUpdater) extendLock(ctx context.Context, cartKey string, token string, ttl time.Duration) (bool, error) {
+	extended, err := extendLockScript.Run(
+		ctx,
+		r.client,
+		[]string{lockingSemaphore(cartKey)},
+		token,
+		ttl.Milliseconds(),
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("error extending lock: %w", err)
+	}
+
+	return extended == 1, nil
+}
+
 // internal function extracted purely for use in tests
 func lockingSemaphore(cartID string) string {
 	return fmt.Sprintf("%s:%s", cartID, "mutex")
@@ -107,3 +533,33 @@ func lockingSemaphore(cartID string) string {
 func blockingSemaphore(cartID string) string {
 	return fmt.Sprintf("%s:%s", cartID, "block")
 }
+
+// internal function extracted purely for use in tests
+func fencingTokenCounter(cartID string) string {
+	return fmt.Sprintf("%s:%s", cartID, "fence")
+}
+
+// internal function extracted purely for use in tests
+func committedFencingToken(cartID string) string {
+	return fmt.Sprintf("%s:%s", cartID, "fence:committed")
+}
+
+// internal function extracted purely for use in tests
+func waitingQueue(cartID string) string {
+	return fmt.Sprintf("%s:%s", cartID, "queue")
+}
+
+// internal function extracted purely for use in tests
+func waitingDeadlines(cartID string) string {
+	return fmt.Sprintf("%s:%s", cartID, "queue:deadlines")
+}
+
+// internal function extracted purely for use in tests
+func waitingTicketCounter(cartID string) string {
+	return fmt.Sprintf("%s:%s", cartID, "queue:tickets")
+}
+
+// internal function extracted purely for use in tests
+func waitingSemaphore(cartID string, token string) string {
+	return fmt.Sprintf("%s:%s:%s", cartID, "block", token)
+}
@@ -2,30 +2,70 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/require"
 )
 
 func TestRedisUpdateCartWithContextReturnsErrorIfErrorAcquiringLock(t *testing.T) {
 	client := MustRedisTestClient()
-	updater := NewRedisCartUpdater(client)
+	updater := MustRedisCartUpdater(client)
 	cartID := uuid.NewV4().String()
+	// will error because the queue of waiters is not a sorted set
+	_, err := client.Set(context.Background(), waitingQueue(cartID), "irrelevant", time.Second).Result()
+	require.NoError(t, err)
 
-	// will error because deadline will be invalid given that context has no deadline
-	err := updater.UpdateCartWithContext(context.Background(), cartID, func(cart *Cart) *Cart { return cart })
+	err = updater.UpdateCartWithContext(context.Background(), cartID, func(cart *Cart) *Cart { return cart })
 
 	require.Error(t, err)
 	require.Regexp(t, "error acquiring lock", err.Error())
 }
 
+func TestRedisUpdateCartWithContextHoldsLockForDefaultTTLGivenContextWithoutDeadline(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client, WithDefaultLockTTL(time.Minute))
+	cartID := uuid.NewV4().String()
+
+	err := updater.UpdateCartWithContext(context.Background(), cartID, func(cart *Cart) *Cart {
+		ttl, err := client.PTTL(context.Background(), lockingSemaphore(cartID)).Result()
+		require.NoError(t, err)
+		require.Greater(t, int64(ttl), int64(59*time.Second))
+		cart.CartDetails["food"] = map[DinerID]int{"diner": 1}
+		return cart
+	})
+
+	require.NoError(t, err)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+}
+
+func TestRedisUpdateCartWithContextGivesUpAfterMaxWaitGivenContextWithoutDeadline(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client, WithMaxWait(20*time.Millisecond))
+	cartID := uuid.NewV4().String()
+	_, err := client.SetNX(context.Background(), lockingSemaphore(cartID), semaphoreToken, time.Second).Result()
+	require.NoError(t, err)
+
+	err = updater.UpdateCartWithContext(context.Background(), cartID, func(cart *Cart) *Cart { return cart })
+
+	require.Error(t, err)
+	require.Regexp(t, "timed out waiting for lock", err.Error())
+	require.True(t, errors.Is(err, ErrLockTimeout))
+}
+
 func TestRedisUpdateCartWithContextReturnsErrorIfItTimesOutWaitingOnLock(t *testing.T) {
 	client := MustRedisTestClient()
-	updater := NewRedisCartUpdater(client)
+	updater := MustRedisCartUpdater(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFunc()
 	// lock out semaphore token for time > ctx deadline
 	// hacky, but better than having flappy tests due to races
 	// trying to call multiple UpdateCartWithContext in parallel
@@ -40,9 +80,10 @@ func TestRedisUpdateCartWithContextReturnsErrorIfItTimesOutWaitingOnLock(t *test
 
 func TestRedisUpdateCartWithContextReturnsErrorIfErrorRetrievingExistingCartFromRedis(t *testing.T) {
 	client := MustRedisTestClient()
-	updater := NewRedisCartUpdater(client)
+	updater := MustRedisCartUpdater(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
 	_, err := client.LPush(ctx, cartID, "irrelevant").Result()
 	require.NoError(t, err)
 	defer func() {
@@ -57,9 +98,10 @@ func TestRedisUpdateCartWithContextReturnsErrorIfErrorRetrievingExistingCartFrom
 
 func TestRedisUpdateCartWithContextReturnsErrorIfExistingCartIsInvalidJSON(t *testing.T) {
 	client := MustRedisTestClient()
-	updater := NewRedisCartUpdater(client)
+	updater := MustRedisCartUpdater(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
 	_, err := client.Set(ctx, cartID, "totally not JSON", 100*time.Millisecond).Result()
 	require.NoError(t, err)
 
@@ -71,9 +113,10 @@ func TestRedisUpdateCartWithContextReturnsErrorIfExistingCartIsInvalidJSON(t *te
 
 func TestRedisUpdateCartWithContextReturnsErrorIfErrorSavingCart(t *testing.T) {
 	client := MustRedisTestClient()
-	updater := NewRedisCartUpdater(client)
+	updater := MustRedisCartUpdater(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelFunc()
 
 	err := updater.UpdateCartWithContext(
 		ctx,
@@ -92,9 +135,10 @@ func TestRedisUpdateCartWithContextReturnsErrorIfErrorSavingCart(t *testing.T) {
 
 func TestRedisUpdateCartWithContextSavesCart(t *testing.T) {
 	client := MustRedisTestClient()
-	updater := NewRedisCartUpdater(client)
+	updater := MustRedisCartUpdater(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
 
 	err := updater.UpdateCartWithContext(
 		ctx,
@@ -112,7 +156,7 @@ func TestRedisUpdateCartWithContextSavesCart(t *testing.T) {
 	)
 
 	require.NoError(t, err)
-	reader := NewRedisCartReader(client)
+	reader := MustRedisCartReader(client)
 	cart, err := reader.ReadCartWithContext(ctx, cartID)
 	require.NoError(t, err)
 	require.Equal(t, cartID, cart.CartID)
@@ -121,9 +165,10 @@ func TestRedisUpdateCartWithContextSavesCart(t *testing.T) {
 
 func TestRedisUpdateCartWithContextBlocksUntilLockIsAvailableAndSavesCart(t *testing.T) {
 	client := MustRedisTestClient()
-	updater := NewRedisCartUpdater(client)
+	updater := MustRedisCartUpdater(client)
 	cartID := uuid.NewV4().String()
-	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
 	_, err := client.SetNX(ctx, lockingSemaphore(cartID), semaphoreToken, 20*time.Millisecond).Result()
 	go func() {
 		time.Sleep(20 * time.Millisecond)
@@ -152,9 +197,474 @@ func TestRedisUpdateCartWithContextBlocksUntilLockIsAvailableAndSavesCart(t *tes
 	)
 
 	require.NoError(t, err)
-	reader := NewRedisCartReader(client)
+	reader := MustRedisCartReader(client)
 	cart, err := reader.ReadCartWithContext(ctx, cartID)
 	require.NoError(t, err)
 	require.Equal(t, cartID, cart.CartID)
 	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
 }
+
+func TestRedisUpdateCartWithContextReturnsErrLockLostIfLockChangesHandsBeforeCommit(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(
+		ctx,
+		cartID,
+		// simulates our lock expiring and being acquired by another updater
+		func(cart *Cart) *Cart {
+			client.Set(ctx, lockingSemaphore(cartID), "another updater", 100*time.Millisecond)
+			cart.CartDetails["food"] = map[DinerID]int{"diner": 1}
+			return cart
+		},
+	)
+
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrLockLost))
+	owner, err := client.Get(ctx, lockingSemaphore(cartID)).Result()
+	require.NoError(t, err)
+	require.Equal(t, "another updater", owner)
+	exists, err := client.Exists(ctx, cartID).Result()
+	require.NoError(t, err)
+	require.Zero(t, exists)
+}
+
+func TestRedisUpdateCartWithContextReleasesLockIfUpdateFails(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.Set(ctx, cartID, "totally not JSON", 100*time.Millisecond).Result()
+	require.NoError(t, err)
+
+	err = updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart })
+
+	require.Error(t, err)
+	exists, err := client.Exists(ctx, lockingSemaphore(cartID)).Result()
+	require.NoError(t, err)
+	require.Zero(t, exists)
+}
+
+func TestRedisCartUpdaterReleaseLockDoesNotReleaseLockHeldByAnotherOwner(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.Set(ctx, lockingSemaphore(cartID), "another updater", 100*time.Millisecond).Result()
+	require.NoError(t, err)
+
+	require.NoError(t, updater.releaseLock(cartID, "not the owner"))
+
+	owner, err := client.Get(ctx, lockingSemaphore(cartID)).Result()
+	require.NoError(t, err)
+	require.Equal(t, "another updater", owner)
+}
+
+func TestRedisCartUpdaterExtendLockOnlyExtendsLockHeldByOwner(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.Set(ctx, lockingSemaphore(cartID), "owner", 100*time.Millisecond).Result()
+	require.NoError(t, err)
+
+	extended, err := updater.extendLock(ctx, cartID, "not the owner", time.Minute)
+	require.NoError(t, err)
+	require.False(t, extended)
+
+	extended, err = updater.extendLock(ctx, cartID, "owner", time.Minute)
+	require.NoError(t, err)
+	require.True(t, extended)
+	ttl, err := client.PTTL(ctx, lockingSemaphore(cartID)).Result()
+	require.NoError(t, err)
+	require.Greater(t, ttl, 100*time.Millisecond)
+}
+
+func TestRedisUpdateCartWithContextRejectsWriteFromPausedHolderWithStaleFencingToken(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(
+		ctx,
+		cartID,
+		// simulates the holder pausing for longer than its lease, during
+		// which another updater acquires the lock and commits its cart
+		func(cart *Cart) *Cart {
+			client.Del(ctx, lockingSemaphore(cartID))
+			err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+				cart.CartDetails["fresh food"] = map[DinerID]int{"diner": 1}
+				return cart
+			})
+			require.NoError(t, err)
+			client.Set(ctx, lockingSemaphore(cartID), "yet another updater", 100*time.Millisecond)
+
+			cart.CartDetails["stale food"] = map[DinerID]int{"diner": 1}
+			return cart
+		},
+	)
+
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrStaleFencingToken))
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, 1, cart.CartDetails["fresh food"]["diner"])
+	require.NotContains(t, cart.CartDetails, ItemID("stale food"))
+}
+
+func TestRedisUpdateCartWithContextCommitsIncreasingFencingTokens(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart }))
+	first, err := client.Get(ctx, committedFencingToken(cartID)).Int64()
+	require.NoError(t, err)
+	require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart }))
+	second, err := client.Get(ctx, committedFencingToken(cartID)).Int64()
+	require.NoError(t, err)
+
+	require.Greater(t, second, first)
+}
+
+func TestRedisUpdateCartWithContextMigratesLegacyCartToHash(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1}}}, true)
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"]["diner2"] = 2
+		return cart
+	})
+
+	require.NoError(t, err)
+	fields, err := client.HGetAll(ctx, cartID).Result()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		cartField("food", "diner1"): "1",
+		cartField("food", "diner2"): "2",
+	}, fields)
+}
+
+func TestRedisUpdateCartWithContextOnlyWritesChangedFields(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1}, "drink": {"diner1": 1}}}, false)
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		// a field changed by someone bypassing the updater after our read
+		// survives because we never touch fields we did not change
+		client.HSet(ctx, cartID, cartField("food", "diner1"), 5)
+		cart.CartDetails["drink"]["diner2"] = 2
+		delete(cart.CartDetails["drink"], "diner1")
+		return cart
+	})
+
+	require.NoError(t, err)
+	fields, err := client.HGetAll(ctx, cartID).Result()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		cartField("food", "diner1"):  "5",
+		cartField("drink", "diner2"): "2",
+	}, fields)
+	ttl, err := client.TTL(ctx, cartID).Result()
+	require.NoError(t, err)
+	require.Greater(t, int64(ttl), int64(0))
+}
+
+func TestRedisUpdateCartWithContextHandsLockOffToWaitersInArrivalOrder(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	_, err := client.SetNX(ctx, lockingSemaphore(cartID), semaphoreToken, time.Minute).Result()
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var order []int
+	var waitGroup sync.WaitGroup
+	// each waiter blocks a pooled connection while it waits, so stay
+	// well within the smallest default pool size of ten connections
+	waiters := 8
+	for waiter := 0; waiter < waiters; waiter++ {
+		waitGroup.Add(1)
+		go func(waiter int) {
+			defer waitGroup.Done()
+			err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+				mutex.Lock()
+				defer mutex.Unlock()
+				order = append(order, waiter)
+				cart.CartDetails["food"] = map[DinerID]int{DinerID(fmt.Sprint(waiter)): 1}
+				return cart
+			})
+			require.NoError(t, err)
+		}(waiter)
+
+		// arrival order is only defined once the waiter has queued up
+		require.Eventually(t, func() bool {
+			return client.ZCard(ctx, waitingQueue(cartID)).Val() == int64(waiter+1)
+		}, time.Second, time.Millisecond)
+	}
+	client.Del(ctx, lockingSemaphore(cartID))
+	client.LPush(ctx, blockingSemaphore(cartID), semaphoreToken)
+	waitGroup.Wait()
+
+	expected := make([]int, waiters)
+	for waiter := range expected {
+		expected[waiter] = waiter
+	}
+	require.Equal(t, expected, order)
+}
+
+func TestRedisUpdateCartWithContextLeavesQueueIfContextIsCancelledWhileWaiting(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+	_, err := client.SetNX(ctx, lockingSemaphore(cartID), semaphoreToken, time.Minute).Result()
+	require.NoError(t, err)
+	impatientCtx, impatientCancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer impatientCancelFunc()
+
+	impatientErr := make(chan error)
+	go func() {
+		impatientErr <- updater.UpdateCartWithContext(impatientCtx, cartID, func(cart *Cart) *Cart { return cart })
+	}()
+	require.Eventually(t, func() bool {
+		return client.ZCard(ctx, waitingQueue(cartID)).Val() == 1
+	}, time.Second, time.Millisecond)
+	patientErr := make(chan error)
+	go func() {
+		patientErr <- updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart })
+	}()
+	require.Eventually(t, func() bool {
+		return client.ZCard(ctx, waitingQueue(cartID)).Val() == 2
+	}, time.Second, time.Millisecond)
+	impatientCancelFunc()
+
+	require.Error(t, <-impatientErr)
+	require.Equal(t, int64(1), client.ZCard(ctx, waitingQueue(cartID)).Val())
+	client.Del(ctx, lockingSemaphore(cartID))
+	client.LPush(ctx, blockingSemaphore(cartID), semaphoreToken)
+	require.NoError(t, <-patientErr)
+}
+
+func TestRedisUpdateCartWithContextEvictsWaitersThatDiedWaiting(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	// queued ahead of us with a deadline that has long passed
+	client.ZAdd(ctx, waitingQueue(cartID), &redis.Z{Score: 0, Member: "dead waiter"})
+	client.ZAdd(ctx, waitingDeadlines(cartID), &redis.Z{Score: 0, Member: "dead waiter"})
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart })
+
+	require.NoError(t, err)
+	require.Zero(t, client.Exists(ctx, waitingQueue(cartID)).Val())
+}
+
+func TestRedisUpdateCartWithContextRenewsLeaseWhileUpdaterIsSlow(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client, WithLockLease(90*time.Millisecond))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		// the lease is independent of the much later deadline
+		ttl, err := client.PTTL(ctx, lockingSemaphore(cartID)).Result()
+		require.NoError(t, err)
+		require.LessOrEqual(t, int64(ttl), int64(90*time.Millisecond))
+
+		time.Sleep(200 * time.Millisecond)
+
+		exists, err := client.Exists(ctx, lockingSemaphore(cartID)).Result()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), exists)
+		cart.CartDetails["food"] = map[DinerID]int{"diner": 1}
+		return cart
+	})
+
+	require.NoError(t, err)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+}
+
+func TestRedisUpdateCartWithContextReturnsErrLockLostIfLeaseIsLost(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client, WithLockLease(30*time.Millisecond))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		// simulates the lease lapsing and the lock being taken by another
+		// updater, which the renewal notices well before the commit
+		client.Set(ctx, lockingSemaphore(cartID), "another updater", time.Second)
+		time.Sleep(50 * time.Millisecond)
+		return cart
+	})
+
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrLockLost))
+	require.Regexp(t, "lease on lock lost", err.Error())
+}
+
+func TestRedisUpdateCartWithContextKeepsErrorOfUpdateIfLeaseIsLost(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client, WithLockLease(30*time.Millisecond))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		client.Set(ctx, lockingSemaphore(cartID), "another updater", time.Second)
+		time.Sleep(50 * time.Millisecond)
+		cart.CartDetails["food"] = ItemDetails{"diner": -1}
+		return cart
+	})
+
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr), "%v", err)
+	require.False(t, errors.Is(err, ErrLockLost))
+}
+
+func TestRedisReleaseLocksReleasesLocksOfUpdatesInProgress(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		require.NoError(t, updater.ReleaseLocks())
+		locked, err := client.Exists(context.Background(), lockingSemaphore(cartID)).Result()
+		require.NoError(t, err)
+		require.Equal(t, int64(0), locked)
+		cart.CartDetails["food"] = map[DinerID]int{"diner": 1}
+		return cart
+	})
+
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrLockLost))
+	require.NoError(t, updater.ReleaseLocks())
+}
+
+func TestRedisUpdateCartWithContextRejectsInvalidCartAndReleasesLock(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1}}}, false)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"]["diner"] = -1
+		return cart
+	})
+
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	require.Equal(t, []FieldError{{Field: "cart_details.food.diner", Message: "must not be negative"}}, validationErr.Fields)
+	locked, err := client.Exists(context.Background(), lockingSemaphore(cartID)).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), locked)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+}
+
+func TestRedisUpdateCartIfVersionWithContextOnlyUpdatesCartAtVersion(t *testing.T) {
+	client := MustRedisTestClient()
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	for _, updater := range []CartUpdater{MustRedisCartUpdater(client), MustRedisOptimisticCartUpdater(client)} {
+		cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+		require.NoError(t, err)
+
+		err = updater.UpdateCartIfVersionWithContext(ctx, cartID, cart.Version+1, func(*Cart) *Cart {
+			require.Fail(t, "updater must not be called on a version mismatch")
+			return nil
+		})
+		require.ErrorIs(t, err, ErrVersionMismatch)
+
+		var updatedCart *Cart
+		err = updater.UpdateCartIfVersionWithContext(ctx, cartID, cart.Version, func(cart *Cart) *Cart {
+			cart.CartDetails["food"] = ItemDetails{"diner": cart.CartDetails["food"]["diner"] + 1}
+			updatedCart = cart
+			return cart
+		})
+		require.NoError(t, err)
+		require.Equal(t, cart.Version+1, updatedCart.Version)
+		savedCart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+		require.NoError(t, err)
+		require.Equal(t, updatedCart.Version, savedCart.Version)
+	}
+}
+
+func TestRedisUpdateCartWithContextNeverReusesVersionsOfEmptiedCarts(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"] = ItemDetails{"diner": 1}
+		return cart
+	}))
+	require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		delete(cart.CartDetails, "food")
+		return cart
+	}))
+
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Empty(t, cart.CartDetails)
+	require.Equal(t, int64(2), cart.Version)
+}
+
+func TestRedisUpdateCartWithContextSavesNothingIfUpdaterAborts(t *testing.T) {
+	client := MustRedisTestClient()
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	for _, updater := range []CartUpdater{MustRedisCartUpdater(client), MustRedisOptimisticCartUpdater(client)} {
+		err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+			cart.CartDetails["food"] = ItemDetails{"diner": 1}
+			return nil
+		})
+
+		require.ErrorIs(t, err, ErrUpdateAborted)
+		cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+		require.NoError(t, err)
+		require.Empty(t, cart.CartDetails)
+		require.Equal(t, int64(0), cart.Version)
+	}
+	// the lock must have been released
+	require.NoError(t, MustRedisCartUpdater(client).UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart }))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// CartEvent is published whenever a cart is saved,
+// with the cart as saved at that version
+type CartEvent struct {
+	Version int64 `json:"version"`
+	Cart    Cart  `json:"cart"`
+}
+
+// CartWatcher streams the events of a cart until ctx is done, events
+// published before it returns being missed and those published while the
+// connection to redis is lost being dropped, which only versions can tell
+type CartWatcher interface {
+	WatchCartWithContext(context.Context, string) (<-chan CartEvent, error)
+}
+
+func cartEvents(cartKey string) string {
+	return fmt.Sprintf("%s:%s", cartKey, "events")
+}
+
+// publishes the cart once saved, which is left to the caller
+// once the transaction committed since only then is its version known
+func (c RedisCartConfig) publishCart(ctx context.Context, client *redis.Client, cartID string, cart *Cart) error {
+	payload, err := json.Marshal(CartEvent{Version: cart.Version, Cart: *cart})
+	if err != nil {
+		return fmt.Errorf("error marshaling cart event: %w", err)
+	}
+	if err := client.Publish(ctx, cartEvents(c.cartKey(cartID)), payload).Err(); err != nil {
+		return fmt.Errorf("error publishing cart event: %w", unavailable(ctx, err))
+	}
+
+	return nil
+}
+
+func (r *RedisCartReader) WatchCartWithContext(ctx context.Context, cartID string) (<-chan CartEvent, error) {
+	pubsub := r.client.Subscribe(ctx, cartEvents(r.config.cartKey(cartID)))
+	// only once the subscription is confirmed is no event missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("error subscribing to cart events: %w", unavailable(ctx, err))
+	}
+
+	events := make(chan CartEvent)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				var event CartEvent
+				if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
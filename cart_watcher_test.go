@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func mustReceiveEvent(t *testing.T, events <-chan CartEvent) CartEvent {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok)
+		return event
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for event")
+		return CartEvent{}
+	}
+}
+
+func TestRedisWatchCartWithContextReceivesCartsAsSaved(t *testing.T) {
+	client := MustRedisTestClient()
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	events, err := MustRedisCartReader(client).WatchCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+
+	for index, updater := range []CartUpdater{MustRedisCartUpdater(client), MustRedisOptimisticCartUpdater(client)} {
+		require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+			cart.CartDetails["food"] = ItemDetails{"diner": index + 1}
+			return cart
+		}))
+
+		event := mustReceiveEvent(t, events)
+		require.Equal(t, int64(index+1), event.Version)
+		require.Equal(t, cartID, event.Cart.CartID)
+		require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": index + 1}}, event.Cart.CartDetails)
+	}
+
+	_, err = MustRedisScriptCartMerger(client).MergeCartWithContext(ctx, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"drink": {"diner": 1}}})
+	require.NoError(t, err)
+	event := mustReceiveEvent(t, events)
+	require.Equal(t, int64(3), event.Version)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 2}, "drink": {"diner": 1}}, event.Cart.CartDetails)
+}
+
+func TestRedisWatchCartWithContextUnsubscribesOnceContextIsDone(t *testing.T) {
+	client := MustRedisTestClient()
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	events, err := MustRedisCartReader(client).WatchCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	subscribers, err := client.PubSubNumSub(context.Background(), cartEvents(cartID)).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), subscribers[cartEvents(cartID)])
+
+	cancelFunc()
+
+	_, ok := <-events
+	require.False(t, ok)
+	require.Eventually(t, func() bool {
+		subscribers, err := client.PubSubNumSub(context.Background(), cartEvents(cartID)).Result()
+		return err == nil && subscribers[cartEvents(cartID)] == 0
+	}, time.Second, 10*time.Millisecond)
+}
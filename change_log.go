@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// every write of a cart is appended to a stream shared by all carts, in the
+// same transaction as the write itself, so that the log has an entry for
+// every version of every cart whether or not anyone was listening at the time
+
+// QuantityChange is the quantity of an item for a diner
+// before and after an update, zero meaning that there was none
+type QuantityChange struct {
+	ItemID  ItemID  `json:"item_id"`
+	DinerID DinerID `json:"diner_id"`
+	Before  int     `json:"before"`
+	After   int     `json:"after"`
+}
+
+// CartChange is a committed update of a cart as logged, with no quantity
+// changes if it saved the cart as it was
+type CartChange struct {
+	// the ID of the entry in the log, by which the change is acknowledged
+	ID        string           `json:"id"`
+	CartID    string           `json:"cart_id"`
+	Version   int64            `json:"version"`
+	Timestamp time.Time        `json:"timestamp"`
+	Changes   []QuantityChange `json:"changes"`
+}
+
+// the version of a write is only known once its INCR has run, so the
+// entry is appended by a script queued right after it in the transaction
+var appendCartChangeScript = redis.NewScript(`
+local args = {"*", "cart_id", ARGV[2], "version", redis.call("GET", KEYS[1]), "timestamp", ARGV[3], "changes", ARGV[4]}
+if tonumber(ARGV[1]) > 0 then
+	return redis.call("XADD", KEYS[2], "MAXLEN", ARGV[1], unpack(args))
+end
+return redis.call("XADD", KEYS[2], unpack(args))
+`)
+
+func (c RedisCartConfig) changeLogKey() string {
+	return c.KeyPrefix + c.ChangeLogKey
+}
+
+// the quantities that differ between the fields of a cart before
+// and after an update, ordered by item then diner
+func quantityChanges(before map[string]int, after map[string]int) []QuantityChange {
+	changes := make([]QuantityChange, 0)
+	record := func(field string) {
+		// fields that cannot be parsed are never written in the first place
+		itemID, dinerID, _ := parseCartField(field)
+		changes = append(changes, QuantityChange{ItemID: itemID, DinerID: dinerID, Before: before[field], After: after[field]})
+	}
+	for field, quantity := range after {
+		if before[field] != quantity {
+			record(field)
+		}
+	}
+	for field := range before {
+		if _, ok := after[field]; !ok {
+			record(field)
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].ItemID != changes[j].ItemID {
+			return changes[i].ItemID < changes[j].ItemID
+		}
+		return changes[i].DinerID < changes[j].DinerID
+	})
+
+	return changes
+}
+
+// queues appending the changes to the log, after the version was incremented
+func (c RedisCartConfig) queueChangeLog(ctx context.Context, pipe redis.Pipeliner, cartID string, changes []QuantityChange) {
+	if c.ChangeLogKey == "" {
+		return
+	}
+
+	// marshaling quantity changes cannot fail
+	payload, _ := json.Marshal(changes)
+	keys := []string{cartVersion(c.cartKey(cartID)), c.changeLogKey()}
+	// EVALSHA could fail for want of the script once the transaction is
+	// committed, too late to fall back to EVAL as Run does
+	appendCartChangeScript.Eval(ctx, pipe, keys, c.ChangeLogMaxLen, cartID, hlcWallTime(c.Clock()), payload)
+}
+
+func cartChangeFromMessage(message redis.XMessage) (CartChange, error) {
+	value := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+
+	change := CartChange{ID: message.ID, CartID: value("cart_id")}
+	var err error
+	if change.Version, err = strconv.ParseInt(value("version"), 10, 64); err != nil {
+		return CartChange{}, fmt.Errorf("invalid version of cart change %s: %w", message.ID, err)
+	}
+	timestamp, err := strconv.ParseInt(value("timestamp"), 10, 64)
+	if err != nil {
+		return CartChange{}, fmt.Errorf("invalid timestamp of cart change %s: %w", message.ID, err)
+	}
+	change.Timestamp = time.Unix(0, timestamp*int64(time.Millisecond))
+	if err := json.Unmarshal([]byte(value("changes")), &change.Changes); err != nil {
+		return CartChange{}, fmt.Errorf("invalid quantity changes of cart change %s: %w", message.ID, err)
+	}
+
+	return change, nil
+}
+
+// decodes the changes read or claimed by the consumer, acknowledging the
+// entries that could never be processed rather than failing every read of
+// them from then on: those trimmed from the log while pending, which come
+// back without values, and those that cannot be decoded
+func (r *RedisCartChangeReader) changesFromMessages(ctx context.Context, messages []redis.XMessage) ([]CartChange, error) {
+	changes := make([]CartChange, 0, len(messages))
+	var unprocessable []string
+	for _, message := range messages {
+		if message.Values == nil {
+			unprocessable = append(unprocessable, message.ID)
+			continue
+		}
+		change, err := cartChangeFromMessage(message)
+		if err != nil {
+			log.Println(err.Error())
+			unprocessable = append(unprocessable, message.ID)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	if err := r.AckChangesWithContext(ctx, unprocessable...); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// CartChangeReader reads the changes of carts as one of a group of consumers,
+// each change going to a single consumer of the group and being read again
+// until acknowledged, so that every change is processed at least once
+type CartChangeReader interface {
+	ReadChangesWithContext(context.Context, int64, time.Duration) ([]CartChange, error)
+	ClaimStaleChangesWithContext(context.Context, time.Duration, int64) ([]CartChange, error)
+	AckChangesWithContext(context.Context, ...string) error
+}
+
+// RedisCartChangeReader reads the change log as a consumer of a consumer
+// group, which is created on first read if need be, starting from the
+// oldest change still logged so that none is missed
+type RedisCartChangeReader struct {
+	client   *redis.Client
+	config   RedisCartConfig
+	group    string
+	consumer string
+}
+
+func NewRedisCartChangeReader(client *redis.Client, group string, consumer string, options ...RedisCartOption) (*RedisCartChangeReader, error) {
+	config, err := newRedisCartConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	if config.ChangeLogKey == "" {
+		return nil, errors.New("invalid redis cart config: change log is disabled")
+	}
+	if group == "" || consumer == "" {
+		return nil, errors.New("consumer group and consumer must be named")
+	}
+
+	return &RedisCartChangeReader{
+		client:   client,
+		config:   config,
+		group:    group,
+		consumer: consumer,
+	}, nil
+}
+
+// reads up to count changes, those the consumer read before without
+// acknowledging them first, then new ones, waiting up to block for any,
+// forever if zero and not at all if negative, returning none if none came
+func (r *RedisCartChangeReader) ReadChangesWithContext(ctx context.Context, count int64, block time.Duration) ([]CartChange, error) {
+	changes, err := r.readChanges(ctx, "0", count, -1)
+	if err != nil || len(changes) > 0 {
+		return changes, err
+	}
+
+	return r.readChanges(ctx, ">", count, block)
+}
+
+func (r *RedisCartChangeReader) readChanges(ctx context.Context, start string, count int64, block time.Duration) ([]CartChange, error) {
+	args := &redis.XReadGroupArgs{
+		Group:    r.group,
+		Consumer: r.consumer,
+		Streams:  []string{r.config.changeLogKey(), start},
+		Count:    count,
+		Block:    block,
+	}
+	streams, err := r.client.XReadGroup(ctx, args).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		if err := r.createGroup(ctx); err != nil {
+			return nil, err
+		}
+		streams, err = r.client.XReadGroup(ctx, args).Result()
+	}
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading cart changes: %w", unavailable(ctx, err))
+	}
+
+	var messages []redis.XMessage
+	for _, stream := range streams {
+		messages = append(messages, stream.Messages...)
+	}
+
+	return r.changesFromMessages(ctx, messages)
+}
+
+func (r *RedisCartChangeReader) createGroup(ctx context.Context) error {
+	err := r.client.XGroupCreateMkStream(ctx, r.config.changeLogKey(), r.group, "0").Err()
+	// another consumer created it first, which is just as good
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("error creating consumer group of cart changes: %w", unavailable(ctx, err))
+	}
+
+	return nil
+}
+
+// takes over up to count changes that other consumers of the group read but
+// did not acknowledge for at least minIdle, such as consumers that are gone
+//
+// the pending changes are listed a page at a time until enough of them are
+// stale, since those of this consumer may well fill the first pages
+func (r *RedisCartChangeReader) ClaimStaleChangesWithContext(ctx context.Context, minIdle time.Duration, count int64) ([]CartChange, error) {
+	var ids []string
+	start := "-"
+	for int64(len(ids)) < count {
+		pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: r.config.changeLogKey(),
+			Group:  r.group,
+			Start:  start,
+			End:    "+",
+			Count:  count,
+		}).Result()
+		if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error listing pending cart changes: %w", unavailable(ctx, err))
+		}
+
+		for _, entry := range pending {
+			if entry.Consumer != r.consumer && entry.Idle >= minIdle && int64(len(ids)) < count {
+				ids = append(ids, entry.ID)
+			}
+		}
+		if int64(len(pending)) < count {
+			break
+		}
+		start = nextStreamID(pending[len(pending)-1].ID)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// changes acknowledged or claimed by others in the meantime are left out
+	messages, err := r.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   r.config.changeLogKey(),
+		Group:    r.group,
+		Consumer: r.consumer,
+		MinIdle:  minIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error claiming stale cart changes: %w", unavailable(ctx, err))
+	}
+
+	return r.changesFromMessages(ctx, messages)
+}
+
+// the smallest ID of a stream entry after the given one, since ranges of
+// pending entries cannot exclude the entry they start from before redis 6.2
+func nextStreamID(id string) string {
+	var milliseconds, sequence uint64
+	// IDs listed by redis always parse
+	fmt.Sscanf(id, "%d-%d", &milliseconds, &sequence)
+	if sequence == math.MaxUint64 {
+		return fmt.Sprintf("%d-0", milliseconds+1)
+	}
+
+	return fmt.Sprintf("%d-%d", milliseconds, sequence+1)
+}
+
+// acknowledges changes once processed, after which the group never reads them again
+func (r *RedisCartChangeReader) AckChangesWithContext(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := r.client.XAck(ctx, r.config.changeLogKey(), r.group, ids...).Err(); err != nil {
+		return fmt.Errorf("error acknowledging cart changes: %w", unavailable(ctx, err))
+	}
+
+	return nil
+}
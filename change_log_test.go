@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// every way of writing carts, given the options of the change log or history
+var cartWriters = []struct {
+	name  string
+	write func(*testing.T, context.Context, []RedisCartOption, string, Cart)
+}{
+	{"locking", func(t *testing.T, ctx context.Context, options []RedisCartOption, cartID string, updates Cart) {
+		require.NoError(t, MustRedisCartUpdater(MustRedisTestClient(), options...).UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+			return compareAndUpdateCart(cart, updates)
+		}))
+	}},
+	{"optimistic", func(t *testing.T, ctx context.Context, options []RedisCartOption, cartID string, updates Cart) {
+		require.NoError(t, MustRedisOptimisticCartUpdater(MustRedisTestClient(), options...).UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+			return compareAndUpdateCart(cart, updates)
+		}))
+	}},
+	{"script", func(t *testing.T, ctx context.Context, options []RedisCartOption, cartID string, updates Cart) {
+		_, err := MustRedisScriptCartMerger(MustRedisTestClient(), options...).MergeCartWithContext(ctx, cartID, updates)
+		require.NoError(t, err)
+	}},
+}
+
+// a change log of its own for the test, deleted once it is over since
+// streams do not expire along with the carts logged to them
+func mustChangeLog(t *testing.T) string {
+	changeLog := uuid.NewV4().String()
+	t.Cleanup(func() {
+		MustRedisTestClient().Del(context.Background(), changeLog)
+	})
+
+	return changeLog
+}
+
+func TestCartWritesAreAppendedToChangeLog(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, writer := range cartWriters {
+		t.Run(writer.name, func(t *testing.T) {
+			options := []RedisCartOption{WithChangeLog(mustChangeLog(t), 0), WithClock(func() time.Time { return now })}
+			cartID := uuid.NewV4().String()
+
+			writer.write(t, context.Background(), options, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}, "drink": {"diner1": 1}}})
+			writer.write(t, context.Background(), options, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 3, "diner2": 2}, "drink": {}}})
+			writer.write(t, context.Background(), options, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 3}}})
+
+			changes, err := MustRedisCartChangeReader(MustRedisTestClient(), "group", "consumer", options...).ReadChangesWithContext(context.Background(), 10, -1)
+			require.NoError(t, err)
+			require.Len(t, changes, 3)
+			for index, change := range changes {
+				require.Equal(t, cartID, change.CartID)
+				require.Equal(t, int64(index+1), change.Version)
+				require.True(t, now.Equal(change.Timestamp))
+			}
+			require.Equal(t, []QuantityChange{
+				{ItemID: "drink", DinerID: "diner1", Before: 0, After: 1},
+				{ItemID: "food", DinerID: "diner1", Before: 0, After: 1},
+				{ItemID: "food", DinerID: "diner2", Before: 0, After: 2},
+			}, changes[0].Changes)
+			require.Equal(t, []QuantityChange{
+				{ItemID: "drink", DinerID: "diner1", Before: 1, After: 0},
+				{ItemID: "food", DinerID: "diner1", Before: 1, After: 3},
+			}, changes[1].Changes)
+			// writes that change nothing still take a version
+			require.Equal(t, []QuantityChange{}, changes[2].Changes)
+		})
+	}
+}
+
+func TestMigratingLegacyCartsAppendsNoQuantityChangesToChangeLog(t *testing.T) {
+	client := MustRedisTestClient()
+	options := []RedisCartOption{WithChangeLog(mustChangeLog(t), 0)}
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1}}}, true)
+
+	_, err := MustRedisScriptCartMerger(client, options...).MergeCartWithContext(context.Background(), cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": 2}}})
+	require.NoError(t, err)
+
+	changes, err := MustRedisCartChangeReader(client, "group", "consumer", options...).ReadChangesWithContext(context.Background(), 10, -1)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.Equal(t, []QuantityChange{}, changes[0].Changes)
+	require.Equal(t, []QuantityChange{{ItemID: "food", DinerID: "diner", Before: 1, After: 2}}, changes[1].Changes)
+}
+
+func TestUpdatesThatAreNotSavedAreNotAppendedToChangeLog(t *testing.T) {
+	client := MustRedisTestClient()
+	changeLog := mustChangeLog(t)
+	updater := MustRedisCartUpdater(client, WithChangeLog(changeLog, 0))
+	cartID := uuid.NewV4().String()
+
+	err := updater.UpdateCartWithContext(context.Background(), cartID, func(*Cart) *Cart { return nil })
+	require.True(t, errors.Is(err, ErrUpdateAborted))
+	err = updater.UpdateCartIfVersionWithContext(context.Background(), cartID, 3, func(cart *Cart) *Cart { return cart })
+	require.True(t, errors.Is(err, ErrVersionMismatch))
+
+	length, err := client.XLen(context.Background(), changeLog).Result()
+	require.NoError(t, err)
+	require.Zero(t, length)
+}
+
+func TestChangeLogIsTrimmedToMaxLen(t *testing.T) {
+	client := MustRedisTestClient()
+	changeLog := mustChangeLog(t)
+	for _, writer := range cartWriters {
+		writer.write(t, context.Background(), []RedisCartOption{WithChangeLog(changeLog, 2)}, uuid.NewV4().String(), NewCart(""))
+	}
+
+	length, err := client.XLen(context.Background(), changeLog).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), length)
+}
+
+func TestCartWritesAreNotLoggedIfChangeLogIsDisabled(t *testing.T) {
+	client := MustRedisTestClient()
+	cartID := uuid.NewV4().String()
+	for _, writer := range cartWriters {
+		writer.write(t, context.Background(), []RedisCartOption{WithChangeLog("", 0), WithKeyPrefix(cartID)}, cartID, NewCart(""))
+	}
+
+	exists, err := client.Exists(context.Background(), cartID+DefaultRedisCartConfig().ChangeLogKey).Result()
+	require.NoError(t, err)
+	require.Zero(t, exists)
+	_, err = NewRedisCartChangeReader(client, "group", "consumer", WithChangeLog("", 0))
+	require.Error(t, err)
+}
+
+func TestRedisCartChangeReaderReadsChangesAtLeastOnceByGroup(t *testing.T) {
+	client := MustRedisTestClient()
+	ctx := context.Background()
+	options := []RedisCartOption{WithChangeLog(mustChangeLog(t), 0)}
+	for range []int{1, 2, 3} {
+		cartWriters[0].write(t, context.Background(), options, uuid.NewV4().String(), NewCart(""))
+	}
+	consumer1 := MustRedisCartChangeReader(client, "group", "consumer1", options...)
+	consumer2 := MustRedisCartChangeReader(client, "group", "consumer2", options...)
+	otherGroup := MustRedisCartChangeReader(client, "other", "consumer", options...)
+
+	// changes logged before the group existed are read all the same
+	changes, err := consumer1.ReadChangesWithContext(ctx, 2, -1)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	otherChanges, err := otherGroup.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Len(t, otherChanges, 3)
+
+	// consumers of the same group share the changes between them
+	remaining, err := consumer2.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	require.Equal(t, otherChanges[2], remaining[0])
+
+	// changes are read again until acknowledged
+	require.NoError(t, consumer1.AckChangesWithContext(ctx, changes[0].ID))
+	redelivered, err := consumer1.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Equal(t, changes[1:], redelivered)
+	require.NoError(t, consumer1.AckChangesWithContext(ctx, changes[1].ID))
+	none, err := consumer1.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Empty(t, none)
+}
+
+func TestRedisCartChangeReaderSkipsChangesThatCannotBeProcessed(t *testing.T) {
+	client := MustRedisTestClient()
+	ctx := context.Background()
+	changeLog := mustChangeLog(t)
+	options := []RedisCartOption{WithChangeLog(changeLog, 0)}
+	consumer := MustRedisCartChangeReader(client, "group", "consumer", options...)
+	cartWriters[0].write(t, ctx, options, uuid.NewV4().String(), NewCart(""))
+	trimmed, err := consumer.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Len(t, trimmed, 1)
+
+	// the change is trimmed from the log while still pending
+	// and followed by a change that cannot be decoded
+	cartWriters[0].write(t, ctx, options, uuid.NewV4().String(), NewCart(""))
+	require.NoError(t, client.XTrim(ctx, changeLog, 1).Err())
+	require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{Stream: changeLog, Values: []string{"version", "none"}}).Err())
+	cartID := uuid.NewV4().String()
+	cartWriters[0].write(t, ctx, options, cartID, NewCart(""))
+
+	for attempt := 0; attempt < 2; attempt++ {
+		changes, err := consumer.ReadChangesWithContext(ctx, 10, -1)
+		require.NoError(t, err)
+		require.Len(t, changes, 2)
+		require.NotEqual(t, trimmed[0].ID, changes[0].ID)
+		require.Equal(t, cartID, changes[1].CartID)
+	}
+
+	pending, err := client.XPending(ctx, changeLog, "group").Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), pending.Count)
+
+	// redis replies with trimmed changes that are pending, without their values,
+	// though not every server that speaks its protocol does
+	changes, err := consumer.changesFromMessages(ctx, []redis.XMessage{{ID: trimmed[0].ID}})
+	require.NoError(t, err)
+	require.Empty(t, changes)
+}
+
+func TestRedisCartChangeReaderWaitsForNewChanges(t *testing.T) {
+	client := MustRedisTestClient()
+	options := []RedisCartOption{WithChangeLog(mustChangeLog(t), 0)}
+	consumer := MustRedisCartChangeReader(client, "group", "consumer", options...)
+	none, err := consumer.ReadChangesWithContext(context.Background(), 10, -1)
+	require.NoError(t, err)
+	require.Empty(t, none)
+
+	cartID := uuid.NewV4().String()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cartWriters[0].write(t, context.Background(), options, cartID, NewCart(""))
+	}()
+
+	changes, err := consumer.ReadChangesWithContext(context.Background(), 10, time.Second)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, cartID, changes[0].CartID)
+}
+
+func TestRedisCartChangeReaderClaimsChangesLeftUnacknowledgedByOtherConsumers(t *testing.T) {
+	client := MustRedisTestClient()
+	ctx := context.Background()
+	options := []RedisCartOption{WithChangeLog(mustChangeLog(t), 0)}
+	cartWriters[0].write(t, context.Background(), options, uuid.NewV4().String(), NewCart(""))
+	gone := MustRedisCartChangeReader(client, "group", "gone", options...)
+	consumer := MustRedisCartChangeReader(client, "group", "consumer", options...)
+	changes, err := gone.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+
+	claimed, err := consumer.ClaimStaleChangesWithContext(ctx, time.Minute, 10)
+	require.NoError(t, err)
+	require.Empty(t, claimed)
+	time.Sleep(20 * time.Millisecond)
+	claimed, err = consumer.ClaimStaleChangesWithContext(ctx, 10*time.Millisecond, 10)
+	require.NoError(t, err)
+	require.Equal(t, changes, claimed)
+
+	// claimed changes are then read again by their new consumer until acknowledged
+	redelivered, err := consumer.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Equal(t, changes, redelivered)
+	require.NoError(t, consumer.AckChangesWithContext(ctx, changes[0].ID))
+	none, err := gone.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Empty(t, none)
+}
+
+func TestRedisCartChangeReaderClaimsChangesBeyondThoseOfItsOwn(t *testing.T) {
+	client := MustRedisTestClient()
+	ctx := context.Background()
+	options := []RedisCartOption{WithChangeLog(mustChangeLog(t), 0)}
+	for index := 0; index < 4; index++ {
+		cartWriters[0].write(t, context.Background(), options, uuid.NewV4().String(), NewCart(""))
+	}
+	gone := MustRedisCartChangeReader(client, "group", "gone", options...)
+	consumer := MustRedisCartChangeReader(client, "group", "consumer", options...)
+	own, err := consumer.ReadChangesWithContext(ctx, 3, -1)
+	require.NoError(t, err)
+	require.Len(t, own, 3)
+	changes, err := gone.ReadChangesWithContext(ctx, 10, -1)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+
+	time.Sleep(20 * time.Millisecond)
+	claimed, err := consumer.ClaimStaleChangesWithContext(ctx, 10*time.Millisecond, 2)
+	require.NoError(t, err)
+	require.Equal(t, changes, claimed)
+}
+
+func TestNextStreamIDFollowsTheGivenID(t *testing.T) {
+	require.Equal(t, "1700000000000-1", nextStreamID("1700000000000-0"))
+	require.Equal(t, "1700000000001-0", nextStreamID("1700000000000-18446744073709551615"))
+}
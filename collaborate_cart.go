@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// the types of messages sent to collaborators
+const (
+	// the cart as saved, whoever saved it
+	cartCollaborationMessage = "cart"
+	// the cart as saved by operations of the collaborator
+	ackCollaborationMessage = "ack"
+	// the problem with operations of the collaborator, none of which were applied
+	errorCollaborationMessage = "error"
+)
+
+// limits of collaborations, beyond which collaborators are disconnected
+const (
+	// messages hold operations only, which are small
+	maxCollaborationRequestSize = 64 * 1024
+	// replies to collaborators that stop reading pile up to this many
+	// before their requests are no longer read, leaving them to wait
+	maxPendingCollaborationReplies = 16
+)
+
+// collaborationRequest is a message from a collaborator, whose operations are
+// applied in a single update, at the version given if any, and replied to
+// with either an ack or an error carrying the same id
+type collaborationRequest struct {
+	ID         string      `json:"id"`
+	IfVersion  *int64      `json:"if_version,omitempty"`
+	Operations []Operation `json:"operations"`
+}
+
+// collaborationMessage is a message to a collaborator, which carries the
+// cart and its version unless it is an error
+type collaborationMessage struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id,omitempty"`
+	Version int64             `json:"version,omitempty"`
+	Cart    *Cart             `json:"cart,omitempty"`
+	Results []OperationResult `json:"results,omitempty"`
+	Problem *Problem          `json:"problem,omitempty"`
+}
+
+var collaborationUpgrader = websocket.Upgrader{
+	// the default of only upgrading requests from the same origin is kept,
+	// browsers being the only clients that send one
+}
+
+// lets collaborators apply operations to the cart over a websocket, acking each
+// message with the version the cart was saved at, and sends every version of
+// the cart saved by anyone, starting with the cart as it is
+//
+// versions saved in quick succession are coalesced for collaborators slow to
+// read them, so that they only ever fall behind by one, and collaborators that
+// stop reading altogether are disconnected once a write is not taken up within
+// the heartbeat interval, as are those that do not answer pings sent at it
+func collaborateOnCart(heartbeatInterval time.Duration, readTimeout time.Duration, updateTimeout time.Duration, cartUpdater CartUpdater, cartReader CartReader, streams *streamGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cartID := mux.Vars(r)["cartID"]
+		cartWatcher, ok := cartReader.(CartWatcher)
+		if !ok {
+			writeProblem(w, http.StatusNotImplemented, notImplementedProblem, "carts cannot be watched", nil)
+			return
+		}
+
+		// every update made by the collaborator is theirs
+		ctx, cancelFunc := context.WithCancel(WithUpdateAudit(r.Context(), UpdateAudit{Author: DinerID(r.Header.Get(DinerIDHeader))}))
+		defer cancelFunc()
+
+		events, currentCart, ok := watchThenReadCart(ctx, cartWatcher, cartReader, readTimeout, w, cartID)
+		if !ok {
+			return
+		}
+
+		// tracked before being hijacked so that shutdown cannot miss it
+		defer streams.hijack()()
+		// the upgrader responds by itself to requests it cannot upgrade
+		conn, err := collaborationUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		replies := make(chan collaborationMessage, maxPendingCollaborationReplies)
+		readDone := make(chan struct{})
+		go func() {
+			defer close(readDone)
+			defer cancelFunc()
+			readCollaborationRequests(ctx, conn, 2*heartbeatInterval, updateTimeout, cartUpdater, cartID, replies)
+		}()
+		// no update is left running once the collaboration ended
+		defer func() {
+			cancelFunc()
+			conn.Close()
+			<-readDone
+		}()
+		latestEvent := coalesceCartEvents(events)
+
+		write := func(message interface{}) bool {
+			conn.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+			if err := conn.WriteJSON(message); err != nil {
+				log.Println(err.Error())
+				return false
+			}
+			return true
+		}
+
+		lastVersion := currentCart.Version
+		if !write(collaborationMessage{Type: cartCollaborationMessage, Version: currentCart.Version, Cart: &currentCart}) {
+			return
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-streams.stopped():
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(heartbeatInterval))
+				return
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeatInterval)); err != nil {
+					log.Println(err.Error())
+					return
+				}
+			case reply := <-replies:
+				if !write(reply) {
+					return
+				}
+				if reply.Version > lastVersion {
+					lastVersion = reply.Version
+				}
+			case event, ok := <-latestEvent:
+				if !ok {
+					return
+				}
+				// acks already carried the cart at their version
+				if event.Version <= lastVersion {
+					continue
+				}
+				if !write(collaborationMessage{Type: cartCollaborationMessage, Version: event.Version, Cart: &event.Cart}) {
+					return
+				}
+				lastVersion = event.Version
+			}
+		}
+	})
+}
+
+// applies the operations of every request in turn until the connection
+// fails, which includes the collaborator not being heard from in time
+func readCollaborationRequests(ctx context.Context, conn *websocket.Conn, readTimeout time.Duration, updateTimeout time.Duration, cartUpdater CartUpdater, cartID string, replies chan<- collaborationMessage) {
+	conn.SetReadLimit(maxCollaborationRequestSize)
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err.Error())
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+		var reply collaborationMessage
+		var request collaborationRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			problem := newProblem(http.StatusBadRequest, badRequestProblem, "the message cannot be decoded", []FieldError{{Message: err.Error()}})
+			reply = collaborationMessage{Type: errorCollaborationMessage, Problem: &problem}
+		} else {
+			audit := updateAuditFromContext(ctx)
+			audit.Payload = auditPayload(data)
+			reply = applyCollaborationRequest(WithUpdateAudit(ctx, audit), updateTimeout, cartUpdater, cartID, request)
+		}
+
+		// replies that are not written hold up the next request
+		select {
+		case replies <- reply:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applies the operations of the request in a single update, all or none of them
+func applyCollaborationRequest(ctx context.Context, updateTimeout time.Duration, cartUpdater CartUpdater, cartID string, request collaborationRequest) collaborationMessage {
+	ctx, cancelFunc := context.WithTimeout(ctx, updateTimeout)
+	defer cancelFunc()
+
+	var err error
+	var finalCart *Cart
+	var results []OperationResult
+	if err = validateOperations(request.Operations); err == nil {
+		updaterFunc := func(currentCart *Cart) *Cart {
+			// from scratch since the update may be retried
+			results = applyOperations(currentCart, request.Operations)
+			finalCart = currentCart
+			return currentCart
+		}
+		if request.IfVersion == nil {
+			err = cartUpdater.UpdateCartWithContext(ctx, cartID, updaterFunc)
+		} else {
+			err = cartUpdater.UpdateCartIfVersionWithContext(ctx, cartID, *request.IfVersion, updaterFunc)
+		}
+	}
+	if err == nil && finalCart == nil {
+		err = errors.New("error applying operations: cart updater returned without updating")
+	}
+	if err != nil {
+		log.Println(err.Error())
+		problem := errorProblem(ctx, err)
+		return collaborationMessage{Type: errorCollaborationMessage, ID: request.ID, Problem: &problem}
+	}
+
+	return collaborationMessage{Type: ackCollaborationMessage, ID: request.ID, Version: finalCart.Version, Cart: finalCart, Results: results}
+}
+
+// keeps only the latest of the events not yet received, so that
+// receiving them slowly never holds up watching the cart
+func coalesceCartEvents(events <-chan CartEvent) <-chan CartEvent {
+	latest := make(chan CartEvent, 1)
+	go func() {
+		defer close(latest)
+		for event := range events {
+			// this is the only sender, so there is room once drained
+			select {
+			case pending := <-latest:
+				if pending.Version > event.Version {
+					event = pending
+				}
+			default:
+			}
+			latest <- event
+		}
+	}()
+
+	return latest
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// a simulated client collaborating on a cart
+type collaborator struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// connects to the cart on the server, as if from another device
+func mustCollaborate(t *testing.T, serverURL string, cartID string) *collaborator {
+	url := "ws" + strings.TrimPrefix(serverURL, "http") + "/carts/" + cartID + "/ws"
+	conn, response, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	t.Cleanup(func() { conn.Close() })
+
+	return &collaborator{t: t, conn: conn}
+}
+
+func (c *collaborator) mustSend(request string) {
+	require.NoError(c.t, c.conn.WriteMessage(websocket.TextMessage, []byte(request)))
+}
+
+func (c *collaborator) mustReceive() collaborationMessage {
+	var message collaborationMessage
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(time.Second)))
+	require.NoError(c.t, c.conn.ReadJSON(&message))
+
+	return message
+}
+
+// receives messages until the reply to the request with the id,
+// skipping the carts saved in the meantime, by anyone
+func (c *collaborator) mustReceiveReply(id string) collaborationMessage {
+	for {
+		message := c.mustReceive()
+		if message.Type != cartCollaborationMessage {
+			require.Equal(c.t, id, message.ID)
+			return message
+		}
+	}
+}
+
+// receives messages until one carries the cart at the version, failing if
+// carts ever go back to versions already seen, and returns the latest cart
+// along with every message received
+func (c *collaborator) mustReceiveUntil(version int64) (*Cart, []collaborationMessage) {
+	var latestCart *Cart
+	var messages []collaborationMessage
+	latestVersion := int64(-1)
+	for latestVersion < version {
+		message := c.mustReceive()
+		require.NotEqual(c.t, errorCollaborationMessage, message.Type)
+		// acks may trail the carts that peers saved since
+		if message.Type == cartCollaborationMessage {
+			require.Greater(c.t, message.Version, latestVersion)
+		}
+		if message.Version > latestVersion {
+			latestCart, latestVersion = message.Cart, message.Version
+		}
+		messages = append(messages, message)
+	}
+	require.Equal(c.t, version, latestVersion)
+
+	return latestCart, messages
+}
+
+func TestRouterStartsCollaborationsWithCartAsItIs(t *testing.T) {
+	_, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	message := mustCollaborate(t, server.URL, cartID).mustReceive()
+
+	require.Equal(t, cartCollaborationMessage, message.Type)
+	require.Equal(t, int64(1), message.Version)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 1}}, message.Cart.CartDetails)
+}
+
+func TestRouterAcksOperationsOfCollaboratorsAndBroadcastsThemAcrossInstances(t *testing.T) {
+	client := MustRedisTestClient()
+	var servers []*httptest.Server
+	for range []string{"instance1", "instance2"} {
+		server := httptest.NewServer(newRouter(DefaultConfig().HTTP, DefaultCartLimits(), MustRedisCartUpdater(client), MustRedisCartReader(client), nil))
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+	cartID := uuid.NewV4().String()
+	sender := mustCollaborate(t, servers[0].URL, cartID)
+	peers := []*collaborator{mustCollaborate(t, servers[0].URL, cartID), mustCollaborate(t, servers[1].URL, cartID)}
+	for _, collaborator := range append(peers, sender) {
+		require.Equal(t, cartCollaborationMessage, collaborator.mustReceive().Type)
+	}
+
+	sender.mustSend(`{"id": "first", "operations": [{"op": "inc", "item_id": "food", "diner_id": "diner", "amount": 2}]}`)
+
+	ack := sender.mustReceiveReply("first")
+	require.Equal(t, ackCollaborationMessage, ack.Type)
+	require.Equal(t, int64(1), ack.Version)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 2}}, ack.Cart.CartDetails)
+	require.Equal(t, []OperationResult{
+		{Operation: Operation{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 2}, Quantity: 2},
+	}, ack.Results)
+	for _, peer := range peers {
+		message := peer.mustReceive()
+		require.Equal(t, cartCollaborationMessage, message.Type)
+		require.Equal(t, int64(1), message.Version)
+		require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 2}}, message.Cart.CartDetails)
+	}
+}
+
+func TestRouterAppliesConcurrentOperationsOfManyCollaborators(t *testing.T) {
+	_, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+	collaborators := make([]*collaborator, 5)
+	for index := range collaborators {
+		collaborators[index] = mustCollaborate(t, server.URL, cartID)
+		collaborators[index].mustReceive()
+	}
+
+	var wg sync.WaitGroup
+	for index := range collaborators {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			collaborators[index].mustSend(fmt.Sprintf(`{"id": "%d", "operations": [{"op": "inc", "item_id": "food", "diner_id": "diner", "amount": 1}]}`, index))
+		}(index)
+	}
+	wg.Wait()
+
+	for index, collaborator := range collaborators {
+		latestCart, messages := collaborator.mustReceiveUntil(int64(len(collaborators)))
+		acks := 0
+		for _, message := range messages {
+			if message.Type == ackCollaborationMessage {
+				require.Equal(t, fmt.Sprint(index), message.ID)
+				acks++
+			}
+		}
+		// the ack may still be to come once the latest cart was seen
+		if acks == 0 {
+			require.Equal(t, ackCollaborationMessage, collaborator.mustReceiveReply(fmt.Sprint(index)).Type)
+			acks++
+		}
+		require.Equal(t, 1, acks)
+		require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": len(collaborators)}}, latestCart.CartDetails)
+	}
+}
+
+func TestRouterRepliesToCollaboratorsWithProblemsOfTheirOperations(t *testing.T) {
+	_, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+	collaborator := mustCollaborate(t, server.URL, cartID)
+	collaborator.mustReceive()
+
+	for _, testCase := range []struct {
+		name    string
+		request string
+		id      string
+		code    string
+	}{
+		{"undecodable", `{"operations": [`, "", badRequestProblem},
+		{"invalid", `{"id": "invalid", "operations": [{"op": "inc", "item_id": "food", "diner_id": "diner"}]}`, "invalid", validationProblem},
+		{"stale", `{"id": "stale", "if_version": 3, "operations": [{"op": "inc", "item_id": "food", "diner_id": "diner", "amount": 1}]}`, "stale", versionMismatchProblem},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			collaborator.mustSend(testCase.request)
+
+			message := collaborator.mustReceiveReply(testCase.id)
+			require.Equal(t, errorCollaborationMessage, message.Type)
+			require.Equal(t, testCase.code, message.Problem.Code)
+		})
+	}
+
+	// problems leave the collaboration open and the cart as it was
+	collaborator.mustSend(`{"id": "valid", "if_version": 0, "operations": [{"op": "set", "item_id": "food", "diner_id": "diner", "amount": 1}]}`)
+	ack := collaborator.mustReceiveReply("valid")
+	require.Equal(t, ackCollaborationMessage, ack.Type)
+	require.Equal(t, int64(1), ack.Version)
+}
+
+func TestRouterCatchesSlowCollaboratorsUpWithTheLatestCart(t *testing.T) {
+	_, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+	collaborator := mustCollaborate(t, server.URL, cartID)
+	collaborator.mustReceive()
+
+	for quantity := 1; quantity <= 20; quantity++ {
+		response := serveRouter(t, router, "PATCH", "/carts/"+cartID, fmt.Sprintf(`{"cart_details": {"food": {"diner": %d}}}`, quantity), nil)
+		require.Equal(t, http.StatusOK, response.Code)
+	}
+
+	latestCart, _ := collaborator.mustReceiveUntil(20)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 20}}, latestCart.CartDetails)
+}
+
+func TestCoalesceCartEventsKeepsOnlyTheLatestEventNotYetReceived(t *testing.T) {
+	events := make(chan CartEvent)
+	latest := coalesceCartEvents(events)
+
+	for _, version := range []int64{1, 3, 2} {
+		events <- CartEvent{Version: version}
+	}
+	close(events)
+
+	require.Equal(t, CartEvent{Version: 3}, <-latest)
+	_, ok := <-latest
+	require.False(t, ok)
+}
+
+func TestRouterDisconnectsCollaboratorsThatStopReading(t *testing.T) {
+	client := MustRedisTestClient()
+	config := DefaultConfig().HTTP
+	config.HeartbeatInterval = Duration(10 * time.Millisecond)
+	server := httptest.NewServer(newRouter(config, DefaultCartLimits(), MustRedisCartUpdater(client), MustRedisCartReader(client), nil))
+	t.Cleanup(server.Close)
+	collaborator := mustCollaborate(t, server.URL, uuid.NewV4().String())
+	collaborator.mustReceive()
+
+	// pings are only answered while reading
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, collaborator.conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err := collaborator.conn.ReadMessage()
+	require.Error(t, err)
+	require.NotRegexp(t, "timeout", err.Error())
+}
+
+func TestRouterRejectsCollaborationsWithoutUpgrade(t *testing.T) {
+	_, router := mustRedisRouter()
+
+	response := serveRouter(t, router, "GET", "/carts/"+uuid.NewV4().String()+"/ws", "", nil)
+
+	require.Equal(t, http.StatusBadRequest, response.Code)
+}
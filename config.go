@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const redactedSecret = "REDACTED"
+
+// Duration reads and writes durations as strings such as "2s"
+// rather than as nanoseconds in config files
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2s\": %w", err)
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+
+	return nil
+}
+
+type Config struct {
+	Redis RedisConfig `json:"redis"`
+	HTTP  HTTPConfig  `json:"http"`
+	Cart  CartConfig  `json:"cart"`
+}
+
+type RedisConfig struct {
+	Addr     string    `json:"addr"`
+	Username string    `json:"username"`
+	Password string    `json:"password"`
+	DB       int       `json:"db"`
+	TLS      TLSConfig `json:"tls"`
+}
+
+type TLSConfig struct {
+	Enabled            bool   `json:"enabled"`
+	ServerName         string `json:"server_name"`
+	CAFile             string `json:"ca_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+type HTTPConfig struct {
+	Addr            string   `json:"addr"`
+	ReadTimeout     Duration `json:"read_timeout"`
+	UpdateTimeout   Duration `json:"update_timeout"`
+	AdminTimeout    Duration `json:"admin_timeout"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// how often idle event streams are sent a comment to keep them open
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	// the longest reads may wait for the cart to change
+	MaxPollWait Duration `json:"max_poll_wait"`
+}
+
+type CartConfig struct {
+	UpdateStrategy  UpdateStrategy `json:"update_strategy"`
+	KeyPrefix       string         `json:"key_prefix"`
+	TTL             Duration       `json:"ttl"`
+	LockLease       Duration       `json:"lock_lease"`
+	DefaultLockTTL  Duration       `json:"default_lock_ttl"`
+	MaxWait         Duration       `json:"max_wait"`
+	MaxRetries      int            `json:"max_retries"`
+	MaxQuantity     int            `json:"max_quantity"`
+	MaxItems        int            `json:"max_items"`
+	MaxDiners       int            `json:"max_diners"`
+	MaxBytes        int            `json:"max_bytes"`
+	ReplicaID       string         `json:"replica_id"`
+	ChangeLogKey    string         `json:"change_log_key"`
+	ChangeLogMaxLen int            `json:"change_log_max_len"`
+	HistoryTTL      Duration       `json:"history_ttl"`
+	HistoryMaxLen   int            `json:"history_max_len"`
+}
+
+// the config of the service short of any file, environment variables or
+// flags, which all take precedence over it, see LoadConfig
+func DefaultConfig() Config {
+	cartConfig := DefaultRedisCartConfig()
+
+	return Config{
+		Redis: RedisConfig{
+			Addr: "localhost:6379",
+			DB:   0,
+		},
+		HTTP: HTTPConfig{
+			Addr:              ":8080",
+			ReadTimeout:       Duration(2 * time.Second),
+			UpdateTimeout:     Duration(2 * time.Second),
+			AdminTimeout:      Duration(10 * time.Second),
+			ShutdownTimeout:   Duration(10 * time.Second),
+			HeartbeatInterval: Duration(15 * time.Second),
+			MaxPollWait:       Duration(30 * time.Second),
+		},
+		Cart: CartConfig{
+			UpdateStrategy:  LockingUpdateStrategy,
+			KeyPrefix:       cartConfig.KeyPrefix,
+			TTL:             Duration(cartConfig.CartTTL),
+			LockLease:       Duration(cartConfig.LockLease),
+			DefaultLockTTL:  Duration(cartConfig.DefaultLockTTL),
+			MaxWait:         Duration(cartConfig.MaxWait),
+			MaxRetries:      cartConfig.RetryPolicy.MaxRetries,
+			MaxQuantity:     cartConfig.Limits.MaxQuantity,
+			MaxItems:        cartConfig.Limits.MaxItems,
+			MaxDiners:       cartConfig.Limits.MaxDiners,
+			MaxBytes:        cartConfig.Limits.MaxBytes,
+			ReplicaID:       cartConfig.ReplicaID,
+			ChangeLogKey:    cartConfig.ChangeLogKey,
+			ChangeLogMaxLen: int(cartConfig.ChangeLogMaxLen),
+			HistoryTTL:      Duration(cartConfig.HistoryTTL),
+			HistoryMaxLen:   int(cartConfig.HistoryMaxLen),
+		},
+	}
+}
+
+// setting is a single config value that can be overridden
+// by both an environment variable and a flag of the same name
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(*Config, string) error
+	// boolean flags may be given without a value, as -flag for -flag=true
+	boolean bool
+}
+
+var settings = []setting{
+	{"redis-addr", "REDISYNC_REDIS_ADDR", "redis address as host:port", setString(func(c *Config) *string { return &c.Redis.Addr }), false},
+	{"redis-username", "REDISYNC_REDIS_USERNAME", "redis ACL username", setString(func(c *Config) *string { return &c.Redis.Username }), false},
+	{"redis-password", "REDISYNC_REDIS_PASSWORD", "redis password", setString(func(c *Config) *string { return &c.Redis.Password }), false},
+	{"redis-db", "REDISYNC_REDIS_DB", "redis database number", setInt(func(c *Config) *int { return &c.Redis.DB }), false},
+	{"redis-tls", "REDISYNC_REDIS_TLS", "connect to redis over TLS", setBool(func(c *Config) *bool { return &c.Redis.TLS.Enabled }), true},
+	{"redis-tls-server-name", "REDISYNC_REDIS_TLS_SERVER_NAME", "server name to verify the redis certificate against", setString(func(c *Config) *string { return &c.Redis.TLS.ServerName }), false},
+	{"redis-tls-ca-file", "REDISYNC_REDIS_TLS_CA_FILE", "PEM file of CAs to verify the redis certificate with", setString(func(c *Config) *string { return &c.Redis.TLS.CAFile }), false},
+	{"redis-tls-insecure-skip-verify", "REDISYNC_REDIS_TLS_INSECURE_SKIP_VERIFY", "skip verifying the redis certificate", setBool(func(c *Config) *bool { return &c.Redis.TLS.InsecureSkipVerify }), true},
+	{"http-addr", "REDISYNC_HTTP_ADDR", "HTTP listen address", setString(func(c *Config) *string { return &c.HTTP.Addr }), false},
+	{"read-timeout", "REDISYNC_READ_TIMEOUT", "timeout of cart reads", setDuration(func(c *Config) *Duration { return &c.HTTP.ReadTimeout }), false},
+	{"update-timeout", "REDISYNC_UPDATE_TIMEOUT", "timeout of cart updates", setDuration(func(c *Config) *Duration { return &c.HTTP.UpdateTimeout }), false},
+	{"admin-timeout", "REDISYNC_ADMIN_TIMEOUT", "timeout of admin requests", setDuration(func(c *Config) *Duration { return &c.HTTP.AdminTimeout }), false},
+	{"shutdown-timeout", "REDISYNC_SHUTDOWN_TIMEOUT", "grace period for in-flight requests on shutdown", setDuration(func(c *Config) *Duration { return &c.HTTP.ShutdownTimeout }), false},
+	{"heartbeat-interval", "REDISYNC_HEARTBEAT_INTERVAL", "interval of heartbeats on idle event streams and pings of collaborators", setDuration(func(c *Config) *Duration { return &c.HTTP.HeartbeatInterval }), false},
+	{"max-poll-wait", "REDISYNC_MAX_POLL_WAIT", "longest reads may wait for the cart to change", setDuration(func(c *Config) *Duration { return &c.HTTP.MaxPollWait }), false},
+	{"update-strategy", "REDISYNC_UPDATE_STRATEGY", "cart update strategy, locking, optimistic or script", setUpdateStrategy, false},
+	{"key-prefix", "REDISYNC_KEY_PREFIX", "prefix of every redis key", setString(func(c *Config) *string { return &c.Cart.KeyPrefix }), false},
+	{"cart-ttl", "REDISYNC_CART_TTL", "how long carts live after their last update", setDuration(func(c *Config) *Duration { return &c.Cart.TTL }), false},
+	{"lock-lease", "REDISYNC_LOCK_LEASE", "renewed lease of cart locks, 0 to hold them until the update deadline", setDuration(func(c *Config) *Duration { return &c.Cart.LockLease }), false},
+	{"default-lock-ttl", "REDISYNC_DEFAULT_LOCK_TTL", "TTL of cart locks for updates without a deadline", setDuration(func(c *Config) *Duration { return &c.Cart.DefaultLockTTL }), false},
+	{"max-wait", "REDISYNC_MAX_WAIT", "max wait for cart locks for updates without a deadline", setDuration(func(c *Config) *Duration { return &c.Cart.MaxWait }), false},
+	{"max-retries", "REDISYNC_MAX_RETRIES", "max retries of conflicting optimistic updates", setInt(func(c *Config) *int { return &c.Cart.MaxRetries }), false},
+	{"max-quantity", "REDISYNC_MAX_QUANTITY", "max quantity of an item for a diner", setInt(func(c *Config) *int { return &c.Cart.MaxQuantity }), false},
+	{"max-items", "REDISYNC_MAX_ITEMS", "max items in a cart", setInt(func(c *Config) *int { return &c.Cart.MaxItems }), false},
+	{"max-diners", "REDISYNC_MAX_DINERS", "max diners in a cart", setInt(func(c *Config) *int { return &c.Cart.MaxDiners }), false},
+	{"max-bytes", "REDISYNC_MAX_BYTES", "max size of a cart encoded as JSON", setInt(func(c *Config) *int { return &c.Cart.MaxBytes }), false},
+	{"replica-id", "REDISYNC_REPLICA_ID", "ID of this replica of the carts, unique among those merged together", setString(func(c *Config) *string { return &c.Cart.ReplicaID }), false},
+	{"change-log-key", "REDISYNC_CHANGE_LOG_KEY", "stream every cart write is appended to after the key prefix, none if empty", setString(func(c *Config) *string { return &c.Cart.ChangeLogKey }), false},
+	{"change-log-max-len", "REDISYNC_CHANGE_LOG_MAX_LEN", "number of latest cart writes the change log is trimmed to, 0 for all", setInt(func(c *Config) *int { return &c.Cart.ChangeLogMaxLen }), false},
+	{"history-ttl", "REDISYNC_HISTORY_TTL", "how long cart histories live after their last update, 0 for as long as the cart", setDuration(func(c *Config) *Duration { return &c.Cart.HistoryTTL }), false},
+	{"history-max-len", "REDISYNC_HISTORY_MAX_LEN", "number of latest revisions cart histories are trimmed to, 0 for all", setInt(func(c *Config) *int { return &c.Cart.HistoryMaxLen }), false},
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = Duration(parsed)
+		return nil
+	}
+}
+
+func setUpdateStrategy(c *Config, value string) error {
+	c.Cart.UpdateStrategy = UpdateStrategy(value)
+	return nil
+}
+
+// LoadConfig builds the config from, in increasing order of precedence,
+// the defaults, the JSON config file given by -config or REDISYNC_CONFIG,
+// environment variables and finally flags, and reports whether the
+// effective config should be printed rather than the service run
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, bool, error) {
+	flags := flag.NewFlagSet("redisync", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON config file, also REDISYNC_CONFIG")
+	printConfig := flags.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	for _, setting := range settings {
+		usage := fmt.Sprintf("%s, also %s", setting.usage, setting.env)
+		if setting.boolean {
+			flags.Bool(setting.flag, false, usage)
+		} else {
+			flags.String(setting.flag, "", usage)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	config := DefaultConfig()
+	if *configFile == "" {
+		*configFile, _ = lookupEnv("REDISYNC_CONFIG")
+	}
+	if *configFile != "" {
+		file, err := os.Open(*configFile)
+		if err != nil {
+			return Config{}, false, fmt.Errorf("error reading config file: %w", err)
+		}
+		defer file.Close()
+
+		// catches misspelt settings that would otherwise be silently ignored
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return Config{}, false, fmt.Errorf("error parsing config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, setting := range settings {
+		if value, ok := lookupEnv(setting.env); ok {
+			if err := setting.set(&config, value); err != nil {
+				return Config{}, false, fmt.Errorf("invalid %s: %w", setting.env, err)
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range settings {
+			if setting.flag == f.Name && err == nil {
+				if setErr := setting.set(&config, f.Value.String()); setErr != nil {
+					err = fmt.Errorf("invalid -%s: %w", f.Name, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, false, err
+	}
+
+	return config, *printConfig, config.Validate()
+}
+
+func (c Config) Validate() error {
+	var errs []string
+	if c.Redis.Addr == "" {
+		errs = append(errs, "redis address must be set")
+	}
+	if c.Redis.DB < 0 {
+		errs = append(errs, "redis database must not be negative")
+	}
+	if !c.Redis.TLS.Enabled && (c.Redis.TLS.CAFile != "" || c.Redis.TLS.ServerName != "" || c.Redis.TLS.InsecureSkipVerify) {
+		errs = append(errs, "redis TLS settings require TLS to be enabled")
+	}
+	if c.HTTP.Addr == "" {
+		errs = append(errs, "HTTP address must be set")
+	}
+	if c.HTTP.ReadTimeout <= 0 || c.HTTP.UpdateTimeout <= 0 || c.HTTP.AdminTimeout <= 0 || c.HTTP.ShutdownTimeout <= 0 {
+		errs = append(errs, "read, update, admin and shutdown timeouts must be positive")
+	}
+	if c.HTTP.HeartbeatInterval <= 0 {
+		errs = append(errs, "heartbeat interval must be positive")
+	}
+	if c.HTTP.MaxPollWait <= 0 {
+		errs = append(errs, "max poll wait must be positive")
+	}
+	switch c.Cart.UpdateStrategy {
+	case LockingUpdateStrategy, OptimisticUpdateStrategy, ScriptUpdateStrategy:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown update strategy %q", c.Cart.UpdateStrategy))
+	}
+	if err := c.RedisCartConfig().Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the config that is safe to print
+func (c Config) Redacted() Config {
+	if c.Redis.Password != "" {
+		c.Redis.Password = redactedSecret
+	}
+
+	return c
+}
+
+func (c Config) RedisCartConfig() RedisCartConfig {
+	config := DefaultRedisCartConfig()
+	config.KeyPrefix = c.Cart.KeyPrefix
+	config.CartTTL = time.Duration(c.Cart.TTL)
+	config.LockLease = time.Duration(c.Cart.LockLease)
+	config.DefaultLockTTL = time.Duration(c.Cart.DefaultLockTTL)
+	config.MaxWait = time.Duration(c.Cart.MaxWait)
+	config.RetryPolicy.MaxRetries = c.Cart.MaxRetries
+	config.Limits = CartLimits{
+		MaxQuantity: c.Cart.MaxQuantity,
+		MaxItems:    c.Cart.MaxItems,
+		MaxDiners:   c.Cart.MaxDiners,
+		MaxBytes:    c.Cart.MaxBytes,
+	}
+	config.ReplicaID = c.Cart.ReplicaID
+	config.ChangeLogKey = c.Cart.ChangeLogKey
+	config.ChangeLogMaxLen = int64(c.Cart.ChangeLogMaxLen)
+	config.HistoryTTL = time.Duration(c.Cart.HistoryTTL)
+	config.HistoryMaxLen = int64(c.Cart.HistoryMaxLen)
+
+	return config
+}
+
+func (c Config) RedisOptions() (*redis.Options, error) {
+	options := &redis.Options{
+		Addr:     c.Redis.Addr,
+		Username: c.Redis.Username,
+		Password: c.Redis.Password,
+		DB:       c.Redis.DB,
+	}
+	if !c.Redis.TLS.Enabled {
+		return options, nil
+	}
+
+	options.TLSConfig = &tls.Config{
+		ServerName:         c.Redis.TLS.ServerName,
+		InsecureSkipVerify: c.Redis.TLS.InsecureSkipVerify,
+	}
+	if c.Redis.TLS.CAFile != "" {
+		pem, err := os.ReadFile(c.Redis.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading redis CA file: %w", err)
+		}
+		options.TLSConfig.RootCAs = x509.NewCertPool()
+		if !options.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in redis CA file %s", c.Redis.TLS.CAFile)
+		}
+	}
+
+	return options, nil
+}
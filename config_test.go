@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func lookupEnvFrom(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func mustWriteConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+
+	return path
+}
+
+func TestLoadConfigReturnsDefaultsGivenNothingElse(t *testing.T) {
+	config, printConfig, err := LoadConfig(nil, lookupEnvFrom(nil))
+
+	require.NoError(t, err)
+	require.False(t, printConfig)
+	require.Equal(t, DefaultConfig(), config)
+}
+
+func TestLoadConfigAppliesFileThenEnvironmentThenFlags(t *testing.T) {
+	path := mustWriteConfigFile(t, `{
+		"redis": {"addr": "file:6379", "db": 1},
+		"http": {"addr": ":1111", "read_timeout": "1s"},
+		"cart": {"ttl": "1h"}
+	}`)
+
+	config, _, err := LoadConfig(
+		[]string{"-config", path, "-redis-addr", "flag:6379"},
+		lookupEnvFrom(map[string]string{
+			"REDISYNC_REDIS_ADDR": "env:6379",
+			"REDISYNC_HTTP_ADDR":  ":2222",
+		}),
+	)
+
+	require.NoError(t, err)
+	require.Equal(t, "flag:6379", config.Redis.Addr)
+	require.Equal(t, ":2222", config.HTTP.Addr)
+	require.Equal(t, 1, config.Redis.DB)
+	require.Equal(t, Duration(time.Second), config.HTTP.ReadTimeout)
+	require.Equal(t, Duration(time.Hour), config.Cart.TTL)
+	require.Equal(t, time.Hour, config.RedisCartConfig().CartTTL)
+	// untouched by any source
+	require.Equal(t, DefaultConfig().HTTP.UpdateTimeout, config.HTTP.UpdateTimeout)
+}
+
+func TestLoadConfigReadsConfigFileFromEnvironment(t *testing.T) {
+	path := mustWriteConfigFile(t, `{"redis": {"addr": "file:6379"}}`)
+
+	config, _, err := LoadConfig(nil, lookupEnvFrom(map[string]string{"REDISYNC_CONFIG": path}))
+
+	require.NoError(t, err)
+	require.Equal(t, "file:6379", config.Redis.Addr)
+}
+
+func TestLoadConfigReturnsErrorIfConfigFileHasUnknownSettings(t *testing.T) {
+	path := mustWriteConfigFile(t, `{"redis": {"adress": "file:6379"}}`)
+
+	_, _, err := LoadConfig([]string{"-config", path}, lookupEnvFrom(nil))
+
+	require.Error(t, err)
+	require.Regexp(t, "error parsing config file", err.Error())
+}
+
+func TestLoadConfigReturnsErrorIfConfigFileIsMissing(t *testing.T) {
+	_, _, err := LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}, lookupEnvFrom(nil))
+
+	require.Error(t, err)
+	require.Regexp(t, "error reading config file", err.Error())
+}
+
+func TestLoadConfigReturnsErrorIfEnvironmentVariableIsInvalid(t *testing.T) {
+	_, _, err := LoadConfig(nil, lookupEnvFrom(map[string]string{"REDISYNC_REDIS_DB": "first"}))
+
+	require.Error(t, err)
+	require.Regexp(t, "invalid REDISYNC_REDIS_DB", err.Error())
+}
+
+func TestLoadConfigReturnsErrorIfFlagIsInvalid(t *testing.T) {
+	_, _, err := LoadConfig([]string{"-cart-ttl", "forever"}, lookupEnvFrom(nil))
+
+	require.Error(t, err)
+	require.Regexp(t, "invalid -cart-ttl", err.Error())
+}
+
+func TestLoadConfigReturnsErrorIfConfigIsInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-redis-addr", ""},
+		{"-redis-db", "-1"},
+		{"-redis-tls-insecure-skip-verify"},
+		{"-http-addr", ""},
+		{"-update-timeout", "0s"},
+		{"-admin-timeout", "0s"},
+		{"-shutdown-timeout", "0s"},
+		{"-update-strategy", "pessimistic"},
+		{"-cart-ttl", "1ms"},
+		{"-max-items", "0"},
+	} {
+		_, _, err := LoadConfig(args, lookupEnvFrom(nil))
+
+		require.Error(t, err, args)
+		require.Regexp(t, "invalid config", err.Error())
+	}
+}
+
+func TestLoadConfigAcceptsBooleanFlagsWithoutValues(t *testing.T) {
+	config, _, err := LoadConfig([]string{"-redis-tls", "-redis-tls-insecure-skip-verify=false", "-http-addr", ":9090"}, lookupEnvFrom(map[string]string{
+		"REDISYNC_REDIS_TLS_INSECURE_SKIP_VERIFY": "true",
+	}))
+
+	require.NoError(t, err)
+	require.True(t, config.Redis.TLS.Enabled)
+	require.False(t, config.Redis.TLS.InsecureSkipVerify)
+	require.Equal(t, ":9090", config.HTTP.Addr)
+}
+
+func TestLoadConfigReportsWhetherToPrintConfig(t *testing.T) {
+	_, printConfig, err := LoadConfig([]string{"-print-config"}, lookupEnvFrom(nil))
+
+	require.NoError(t, err)
+	require.True(t, printConfig)
+}
+
+func TestConfigRedactedRedactsSecrets(t *testing.T) {
+	config := DefaultConfig()
+	config.Redis.Password = "hunter2"
+
+	redacted := config.Redacted()
+
+	require.Equal(t, redactedSecret, redacted.Redis.Password)
+	require.Equal(t, "hunter2", config.Redis.Password)
+	require.Empty(t, DefaultConfig().Redacted().Redis.Password)
+}
+
+func TestConfigRedisOptionsConfiguresTLSOnlyIfEnabled(t *testing.T) {
+	config := DefaultConfig()
+
+	options, err := config.RedisOptions()
+	require.NoError(t, err)
+	require.Nil(t, options.TLSConfig)
+
+	config.Redis.TLS.Enabled = true
+	config.Redis.TLS.ServerName = "redis.internal"
+	options, err = config.RedisOptions()
+	require.NoError(t, err)
+	require.Equal(t, "redis.internal", options.TLSConfig.ServerName)
+}
+
+func TestConfigRedisOptionsReturnsErrorIfCAFileHasNoCertificates(t *testing.T) {
+	config := DefaultConfig()
+	config.Redis.TLS.Enabled = true
+	config.Redis.TLS.CAFile = mustWriteConfigFile(t, "not a certificate")
+
+	_, err := config.RedisOptions()
+
+	require.Error(t, err)
+	require.Regexp(t, "no certificates found", err.Error())
+}
+
+func TestExampleConfigFileIsValid(t *testing.T) {
+	config, _, err := LoadConfig([]string{"-config", "config.example.json"}, lookupEnvFrom(nil))
+
+	require.NoError(t, err)
+	require.Equal(t, DefaultConfig(), config)
+}
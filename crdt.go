@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// carts converge across replicas by keeping, for every diner of every item,
+// the quantity last written as a register timestamped with a hybrid logical
+// clock, removals included as registers with a quantity of zero, so that
+// merging the registers of replicas in any order always ends up the same
+
+// HLC is a hybrid logical clock timestamp, which follows wall time
+// where it can but still orders writes made within the same millisecond
+// or on replicas whose clocks lag behind, the replica breaking any ties
+type HLC struct {
+	WallTime int64  `json:"wall_time"`
+	Logical  int64  `json:"logical"`
+	Replica  string `json:"replica"`
+}
+
+func (h HLC) Before(other HLC) bool {
+	if h.WallTime != other.WallTime {
+		return h.WallTime < other.WallTime
+	}
+	if h.Logical != other.Logical {
+		return h.Logical < other.Logical
+	}
+
+	return h.Replica < other.Replica
+}
+
+func (h HLC) String() string {
+	return fmt.Sprintf("%d:%d:%s", h.WallTime, h.Logical, h.Replica)
+}
+
+func parseHLC(value string) (HLC, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return HLC{}, fmt.Errorf("invalid clock %q", value)
+	}
+	wallTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return HLC{}, fmt.Errorf("invalid wall time of clock %q: %w", value, err)
+	}
+	logical, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return HLC{}, fmt.Errorf("invalid logical time of clock %q: %w", value, err)
+	}
+
+	return HLC{WallTime: wallTime, Logical: logical, Replica: parts[2]}, nil
+}
+
+func hlcWallTime(now time.Time) int64 {
+	return now.UnixNano() / int64(time.Millisecond)
+}
+
+// the timestamp of a write on the replica that follows the latest
+// timestamp it has seen, however far behind its wall clock may be
+func nextHLC(latest HLC, now time.Time, replica string) HLC {
+	wallTime := hlcWallTime(now)
+	if latest.WallTime >= wallTime {
+		return HLC{WallTime: latest.WallTime, Logical: latest.Logical + 1, Replica: replica}
+	}
+
+	return HLC{WallTime: wallTime, Replica: replica}
+}
+
+// Register is the last write of the quantity of an item for a diner
+type Register struct {
+	Quantity  int `json:"quantity"`
+	Timestamp HLC `json:"timestamp"`
+}
+
+// the later write wins, and the larger quantity between writes with the same
+// timestamp, which only replicas sharing an ID can make, so that merging
+// is commutative regardless
+func (r Register) wins(other Register) bool {
+	if r.Timestamp != other.Timestamp {
+		return other.Timestamp.Before(r.Timestamp)
+	}
+
+	return r.Quantity > other.Quantity
+}
+
+// ReplicatedCart is the state of a cart that replicas exchange to converge
+type ReplicatedCart struct {
+	CartID    string                          `json:"cart_id"`
+	Registers map[ItemID]map[DinerID]Register `json:"registers"`
+}
+
+// Merge returns the registers of both carts, the winning one of those
+// in both, which is commutative, associative and idempotent
+func (r ReplicatedCart) Merge(other ReplicatedCart) ReplicatedCart {
+	// replicas of a cart share its ID, but any choice would have to commute
+	merged := ReplicatedCart{CartID: r.CartID, Registers: make(map[ItemID]map[DinerID]Register)}
+	if other.CartID > merged.CartID {
+		merged.CartID = other.CartID
+	}
+
+	for _, registers := range []map[ItemID]map[DinerID]Register{r.Registers, other.Registers} {
+		for itemID, diners := range registers {
+			for dinerID, register := range diners {
+				if _, ok := merged.Registers[itemID]; !ok {
+					merged.Registers[itemID] = make(map[DinerID]Register)
+				}
+				if current, ok := merged.Registers[itemID][dinerID]; !ok || register.wins(current) {
+					merged.Registers[itemID][dinerID] = register
+				}
+			}
+		}
+	}
+
+	return merged
+}
+
+// Cart returns the quantities of the registers that have not been removed
+func (r ReplicatedCart) Cart() Cart {
+	cart := NewCart(r.CartID)
+	for itemID, diners := range r.Registers {
+		for dinerID, register := range diners {
+			if register.Quantity == 0 {
+				continue
+			}
+			if _, ok := cart.CartDetails[itemID]; !ok {
+				cart.CartDetails[itemID] = make(ItemDetails)
+			}
+			cart.CartDetails[itemID][dinerID] = register.Quantity
+		}
+	}
+
+	return cart
+}
+
+// Replicated returns the registers of the cart, with quantities that
+// predate clocks being written as early as possible
+func (c Cart) Replicated() ReplicatedCart {
+	replicated := ReplicatedCart{CartID: c.CartID, Registers: make(map[ItemID]map[DinerID]Register)}
+	for field, clock := range c.clocks {
+		if !isCartField(field) {
+			continue
+		}
+		itemID, dinerID, err := parseCartField(field)
+		if err != nil {
+			continue
+		}
+		if _, ok := replicated.Registers[itemID]; !ok {
+			replicated.Registers[itemID] = make(map[DinerID]Register)
+		}
+		replicated.Registers[itemID][dinerID] = Register{Quantity: c.CartDetails[itemID][dinerID], Timestamp: clock}
+	}
+
+	for itemID, itemDetails := range c.CartDetails {
+		for dinerID, quantity := range itemDetails {
+			if _, ok := replicated.Registers[itemID][dinerID]; ok {
+				continue
+			}
+			if _, ok := replicated.Registers[itemID]; !ok {
+				replicated.Registers[itemID] = make(map[DinerID]Register)
+			}
+			replicated.Registers[itemID][dinerID] = Register{Quantity: quantity}
+		}
+	}
+
+	return replicated
+}
+
+// merges the registers of a remote replica into the cart, taking on the
+// timestamps of the remote registers that win so that they are stored as is
+func mergeReplicatedCart(cart *Cart, remote ReplicatedCart) *Cart {
+	merged := cart.Replicated().Merge(remote)
+	clocks := make(map[string]HLC, len(cart.clocks))
+	for field, clock := range cart.clocks {
+		clocks[field] = clock
+	}
+	for itemID, diners := range merged.Registers {
+		for dinerID, register := range diners {
+			if register.Timestamp != (HLC{}) {
+				clocks[cartField(itemID, dinerID)] = register.Timestamp
+			}
+		}
+	}
+
+	cart.CartDetails = merged.Cart().CartDetails
+	cart.clocks = clocks
+
+	return cart
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// draws from few IDs and timestamps so that replicas often
+// hold registers of the same diners written at the same time
+type arbitraryReplica ReplicatedCart
+
+func (arbitraryReplica) Generate(random *rand.Rand, size int) reflect.Value {
+	itemIDs := []ItemID{"food", "drink"}
+	dinerIDs := []DinerID{"diner1", "diner2", "diner3"}
+	replicas := []string{"us", "eu"}
+
+	replica := arbitraryReplica{CartID: "cart", Registers: make(map[ItemID]map[DinerID]Register)}
+	for index := random.Intn(size + 1); index > 0; index-- {
+		itemID := itemIDs[random.Intn(len(itemIDs))]
+		if _, ok := replica.Registers[itemID]; !ok {
+			replica.Registers[itemID] = make(map[DinerID]Register)
+		}
+		replica.Registers[itemID][dinerIDs[random.Intn(len(dinerIDs))]] = Register{
+			Quantity: random.Intn(3),
+			Timestamp: HLC{
+				WallTime: int64(random.Intn(3)),
+				Logical:  int64(random.Intn(2)),
+				Replica:  replicas[random.Intn(len(replicas))],
+			},
+		}
+	}
+
+	return reflect.ValueOf(replica)
+}
+
+func TestReplicatedCartMergeIsCommutative(t *testing.T) {
+	require.NoError(t, quick.Check(func(a, b arbitraryReplica) bool {
+		return reflect.DeepEqual(
+			ReplicatedCart(a).Merge(ReplicatedCart(b)),
+			ReplicatedCart(b).Merge(ReplicatedCart(a)),
+		)
+	}, nil))
+}
+
+func TestReplicatedCartMergeIsAssociative(t *testing.T) {
+	require.NoError(t, quick.Check(func(a, b, c arbitraryReplica) bool {
+		return reflect.DeepEqual(
+			ReplicatedCart(a).Merge(ReplicatedCart(b)).Merge(ReplicatedCart(c)),
+			ReplicatedCart(a).Merge(ReplicatedCart(b).Merge(ReplicatedCart(c))),
+		)
+	}, nil))
+}
+
+func TestReplicatedCartMergeIsIdempotent(t *testing.T) {
+	require.NoError(t, quick.Check(func(a, b arbitraryReplica) bool {
+		merged := ReplicatedCart(a).Merge(ReplicatedCart(b))
+
+		return reflect.DeepEqual(ReplicatedCart(a), ReplicatedCart(a).Merge(ReplicatedCart(a))) &&
+			reflect.DeepEqual(merged, merged.Merge(ReplicatedCart(b)))
+	}, nil))
+}
+
+func TestReplicatedCartMergeKeepsLatestWrites(t *testing.T) {
+	local := ReplicatedCart{CartID: "cart", Registers: map[ItemID]map[DinerID]Register{
+		"food":  {"diner1": {Quantity: 1, Timestamp: HLC{WallTime: 1, Replica: "us"}}, "diner2": {Quantity: 2, Timestamp: HLC{WallTime: 3, Replica: "us"}}},
+		"drink": {"diner1": {Quantity: 1, Timestamp: HLC{WallTime: 1, Replica: "us"}}},
+	}}
+	remote := ReplicatedCart{CartID: "cart", Registers: map[ItemID]map[DinerID]Register{
+		"food":  {"diner1": {Quantity: 3, Timestamp: HLC{WallTime: 2, Replica: "eu"}}, "diner2": {Quantity: 1, Timestamp: HLC{WallTime: 2, Replica: "eu"}}},
+		"drink": {"diner1": {Quantity: 0, Timestamp: HLC{WallTime: 1, Logical: 1, Replica: "eu"}}},
+	}}
+
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 3, "diner2": 2}}, local.Merge(remote).Cart().CartDetails)
+}
+
+func TestHLCFollowsLatestClockAheadOfWallTime(t *testing.T) {
+	now := time.Unix(10, 0)
+	ahead := HLC{WallTime: hlcWallTime(now) + 1000, Logical: 4, Replica: "eu"}
+
+	require.Equal(t, HLC{WallTime: hlcWallTime(now), Replica: "us"}, nextHLC(HLC{}, now, "us"))
+	require.Equal(t, HLC{WallTime: ahead.WallTime, Logical: 5, Replica: "us"}, nextHLC(ahead, now, "us"))
+	require.True(t, ahead.Before(nextHLC(ahead, now, "us")))
+}
+
+func TestHLCRoundTripsReplicasWithColons(t *testing.T) {
+	clock := HLC{WallTime: 1, Logical: 2, Replica: "us:east:1"}
+
+	parsed, err := parseHLC(clock.String())
+
+	require.NoError(t, err)
+	require.Equal(t, clock, parsed)
+}
+
+func TestUpdatesStampChangedFieldsWithClocks(t *testing.T) {
+	client := MustRedisTestClient()
+	now := time.Now()
+	clock := func() time.Time { return now }
+	cartID := uuid.NewV4().String()
+	ctx := context.Background()
+
+	for _, updater := range []CartUpdater{
+		MustRedisCartUpdater(client, WithReplicaID("us"), WithClock(clock)),
+		MustRedisOptimisticCartUpdater(client, WithReplicaID("us"), WithClock(clock)),
+	} {
+		cartID := uuid.NewV4().String()
+		require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+			cart.CartDetails["food"] = ItemDetails{"diner1": 1, "diner2": 1}
+			return cart
+		}))
+		// the wall clock has not moved on since, so the logical clock must
+		require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+			cart.CartDetails["food"] = ItemDetails{"diner1": 2}
+			return cart
+		}))
+
+		cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+		require.NoError(t, err)
+		require.Equal(t, ReplicatedCart{CartID: cartID, Registers: map[ItemID]map[DinerID]Register{
+			"food": {
+				"diner1": {Quantity: 2, Timestamp: HLC{WallTime: hlcWallTime(now), Logical: 1, Replica: "us"}},
+				"diner2": {Quantity: 0, Timestamp: HLC{WallTime: hlcWallTime(now), Logical: 1, Replica: "us"}},
+			},
+		}}, cart.Replicated())
+	}
+
+	merger := MustRedisScriptCartMerger(client, WithReplicaID("eu"), WithClock(clock))
+	_, err := merger.MergeCartWithContext(ctx, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 1}}})
+	require.NoError(t, err)
+	_, err = merger.MergeCartWithContext(ctx, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 2, "diner2": 1}, "drink": {}}})
+	require.NoError(t, err)
+
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, ReplicatedCart{CartID: cartID, Registers: map[ItemID]map[DinerID]Register{
+		"food": {
+			"diner1": {Quantity: 2, Timestamp: HLC{WallTime: hlcWallTime(now), Logical: 1, Replica: "eu"}},
+			"diner2": {Quantity: 1, Timestamp: HLC{WallTime: hlcWallTime(now), Replica: "eu"}},
+		},
+	}}, cart.Replicated())
+}
+
+func TestUpdatesKeepClocksOfMergedRegisters(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisCartUpdater(client, WithReplicaID("us"))
+	cartID := uuid.NewV4().String()
+	ctx := context.Background()
+	ahead := HLC{WallTime: hlcWallTime(time.Now().Add(time.Hour)), Replica: "eu"}
+	remote := ReplicatedCart{CartID: cartID, Registers: map[ItemID]map[DinerID]Register{
+		"food":  {"diner1": {Quantity: 1, Timestamp: ahead}},
+		"drink": {"diner1": {Quantity: 0, Timestamp: ahead}},
+	}}
+
+	require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		return mergeReplicatedCart(cart, remote)
+	}))
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, remote, cart.Replicated())
+
+	// and later writes follow them even though they are ahead of wall time
+	require.NoError(t, updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["drink"] = ItemDetails{"diner1": 1}
+		return cart
+	}))
+	cart, err = MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, HLC{WallTime: ahead.WallTime, Logical: 1, Replica: "us"}, cart.Replicated().Registers["drink"]["diner1"].Timestamp)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrLockTimeout is returned when an update gives up waiting for the cart lock
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// ErrStoreUnavailable is returned when redis cannot be reached at all,
+// as opposed to when it replies with an error
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// ErrVersionMismatch is returned when a conditional update finds
+// the cart at a version other than the one it was conditioned on
+var ErrVersionMismatch = errors.New("cart version does not match")
+
+// ErrInvalidPatch is returned when a patch cannot be applied to the cart
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// ErrPatchTestFailed is returned when a test operation of a JSON Patch
+// finds the cart other than as expected, so that none of it was applied
+var ErrPatchTestFailed = errors.New("patch test failed")
+
+// ErrValidation is matched by every ValidationError
+var ErrValidation = errors.New("invalid cart")
+
+// FieldError is a violation of the rules for a single field of a cart,
+// the field being a JSON path such as cart_details.food.diner, or empty
+// if the violation is down to the cart as a whole
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError reports every field of a cart that is invalid
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", field.Field, field.Message))
+	}
+
+	return fmt.Sprintf("%s: %s", ErrValidation, strings.Join(messages, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// tags an error with the domain error it amounts to while
+// still wrapping it, so that errors.Is matches either
+type domainError struct {
+	kind error
+	err  error
+}
+
+func (e *domainError) Error() string {
+	return e.err.Error()
+}
+
+func (e *domainError) Unwrap() error {
+	return e.err
+}
+
+func (e *domainError) Is(target error) bool {
+	return target == e.kind
+}
+
+func lockTimeout(err error) error {
+	return &domainError{kind: ErrLockTimeout, err: err}
+}
+
+// tags errors reaching redis, which unlike errors replied by redis are
+// worth retrying elsewhere, unless they are down to the context expiring
+func unavailable(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrClosed) ||
+		// the pool does not export its error
+		err.Error() == "redis: connection pool timeout" {
+		return &domainError{kind: ErrStoreUnavailable, err: err}
+	}
+
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidationErrorListsEveryField(t *testing.T) {
+	err := &ValidationError{Fields: []FieldError{
+		{Field: "cart_id", Message: "must not be empty"},
+		{Field: "cart_details.food.diner", Message: "must not be negative"},
+	}}
+
+	require.True(t, errors.Is(fmt.Errorf("wrapped: %w", err), ErrValidation))
+	require.Equal(t, "invalid cart: cart_id: must not be empty; cart_details.food.diner: must not be negative", err.Error())
+}
+
+func TestDomainErrorMatchesBothKindAndCause(t *testing.T) {
+	cause := errors.New("cause")
+	err := fmt.Errorf("wrapped: %w", lockTimeout(cause))
+
+	require.True(t, errors.Is(err, ErrLockTimeout))
+	require.True(t, errors.Is(err, cause))
+	require.False(t, errors.Is(err, ErrStoreUnavailable))
+	require.Equal(t, "wrapped: cause", err.Error())
+}
+
+func TestUnavailableTagsOnlyErrorsReachingRedis(t *testing.T) {
+	expiredCtx, cancelFunc := context.WithTimeout(context.Background(), 0*time.Second)
+	defer cancelFunc()
+	unreachableClient := redis.NewClient(&redis.Options{Addr: "localhost:1", MaxRetries: -1})
+	defer unreachableClient.Close()
+	_, dialErr := unreachableClient.Ping(context.Background()).Result()
+	require.Error(t, dialErr)
+
+	require.True(t, errors.Is(unavailable(context.Background(), dialErr), ErrStoreUnavailable))
+	require.True(t, errors.Is(unavailable(context.Background(), redis.ErrClosed), ErrStoreUnavailable))
+	require.False(t, errors.Is(unavailable(expiredCtx, dialErr), ErrStoreUnavailable))
+	require.False(t, errors.Is(unavailable(context.Background(), redis.Nil), ErrStoreUnavailable))
+	require.False(t, errors.Is(unavailable(context.Background(), ErrLockLost), ErrStoreUnavailable))
+	require.NoError(t, unavailable(context.Background(), nil))
+}
+
+func TestReadersAndUpdatersReturnStoreUnavailableIfRedisIsUnreachable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1", MaxRetries: -1})
+	defer client.Close()
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+	updaterFunc := func(cart *Cart) *Cart { return cart }
+
+	_, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.True(t, errors.Is(err, ErrStoreUnavailable), err)
+
+	err = MustRedisCartUpdater(client).UpdateCartWithContext(ctx, cartID, updaterFunc)
+	require.True(t, errors.Is(err, ErrStoreUnavailable), err)
+
+	err = MustRedisOptimisticCartUpdater(client).UpdateCartWithContext(ctx, cartID, updaterFunc)
+	require.True(t, errors.Is(err, ErrStoreUnavailable), err)
+
+	_, err = MustRedisScriptCartMerger(client).MergeCartWithContext(ctx, cartID, NewCart(cartID))
+	require.True(t, errors.Is(err, ErrStoreUnavailable), err)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// carts are tagged with their version, which changes with every write,
+// so that clients can tell whether a cart changed since they read it
+func cartETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parses the version of a strong ETag, weak ones never matching in If-Match
+func parseCartETag(etag string) (int64, bool) {
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil || !strings.HasPrefix(etag, `"`) {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+
+	return version, true
+}
+
+func splitETags(header string) []string {
+	etags := strings.Split(header, ",")
+	for index := range etags {
+		etags[index] = strings.TrimSpace(etags[index])
+	}
+
+	return etags
+}
+
+// the version of updates conditioned on If-Match: *, which
+// matches any version of the cart as long as it exists
+const existingVersion int64 = -2
+
+// carts that were never written do not exist, unless stored before versions
+// were, which is what If-Match: * and If-None-Match: * are matched against
+func cartExists(cart *Cart) bool {
+	return cart.Version > 0 || len(cart.CartDetails) > 0
+}
+
+// the versions an update is conditioned on by If-Match, any of which the
+// cart must be at, none if there is no If-Match and existingVersion alone
+// for If-Match: *, responding with a problem if no cart can meet them
+func ifMatchVersions(w http.ResponseWriter, r *http.Request) ([]int64, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil, true
+	}
+	if header == "*" {
+		return []int64{existingVersion}, true
+	}
+
+	var versions []int64
+	for _, etag := range splitETags(header) {
+		if version, ok := parseCartETag(etag); ok {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) == 0 {
+		writeProblem(w, http.StatusPreconditionFailed, versionMismatchProblem, "If-Match lists no ETag of this cart", nil)
+		return nil, false
+	}
+
+	return versions, true
+}
+
+// whether the cart is at any of the versions of If-Match, see ifMatchVersions
+func matchesVersions(cart *Cart, versions []int64) bool {
+	for _, version := range versions {
+		if version == cart.Version || (version == existingVersion && cartExists(cart)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responds with 304 if the version of the cart is one of those in
+// If-None-Match, which are compared weakly as is usual for reads,
+// or if it lists * and the cart exists
+func notModified(w http.ResponseWriter, r *http.Request, cart *Cart) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	for _, etag := range splitETags(header) {
+		if (etag == "*" && cartExists(cart)) || strings.TrimPrefix(etag, "W/") == cartETag(cart.Version) {
+			w.Header().Set("ETag", cartETag(cart.Version))
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
@@ -3,7 +3,11 @@ module github.com/s-rangarajan/redisync
 go 1.16
 
 require (
+	github.com/evanphx/json-patch/v5 v5.6.0
 	github.com/go-redis/redis/v8 v8.9.0
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.5.0
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/satori/go.uuid v1.2.0
 	github.com/stretchr/testify v1.7.0
 )
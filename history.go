@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// every write of a cart is also appended to a stream of its own, in the same
+// transaction as the write itself, along with who made it and what they asked
+// for, so that support can tell who changed what and rebuild the cart as of
+// any version still in its history
+//
+// carts are rebuilt by undoing the revisions that followed, newest first,
+// from the cart as it is, which only needs the history to go back as far as
+// the version asked for rather than to the first write of the cart
+//
+// a history that outlives its cart is left with revisions that can be read
+// but not rebuilt, a cart by the same ID starting over from version 1 with
+// its revisions appended to the same history
+
+// ErrRevisionNotFound is returned when a cart is asked for as of a version
+// that it has yet to reach or that its history no longer goes back to
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// UpdateAudit tells who made an update and what they asked for, carried by
+// the context of the update into the history of the cart, see WithUpdateAudit
+type UpdateAudit struct {
+	Author  DinerID
+	Payload json.RawMessage
+}
+
+type updateAuditKey struct{}
+
+// WithUpdateAudit records the audit in the history of
+// the carts that are updated with the returned context
+func WithUpdateAudit(ctx context.Context, audit UpdateAudit) context.Context {
+	return context.WithValue(ctx, updateAuditKey{}, audit)
+}
+
+func updateAuditFromContext(ctx context.Context) UpdateAudit {
+	audit, _ := ctx.Value(updateAuditKey{}).(UpdateAudit)
+	return audit
+}
+
+// CartRevision is a committed update of a cart as recorded in its history
+type CartRevision struct {
+	// the ID of the entry in the history, by which the history is paginated
+	ID        string           `json:"id"`
+	Version   int64            `json:"version"`
+	Timestamp time.Time        `json:"timestamp"`
+	Author    DinerID          `json:"author,omitempty"`
+	Payload   json.RawMessage  `json:"payload,omitempty"`
+	Changes   []QuantityChange `json:"changes"`
+}
+
+func cartHistory(cartKey string) string {
+	return fmt.Sprintf("%s:%s", cartKey, "history")
+}
+
+// the history expires along with the cart unless given a TTL of its own, and
+// is trimmed like the change log so that carts updated for as long as they
+// live do not grow it without bounds
+func (c RedisCartConfig) historyTTL() time.Duration {
+	if c.HistoryTTL > 0 {
+		return c.HistoryTTL
+	}
+
+	return c.CartTTL
+}
+
+// the version of a write is only known once its INCR has run, so the
+// revision is appended by a script queued right after it in the transaction
+var appendCartRevisionScript = redis.NewScript(`
+local args = {"*", "version", redis.call("GET", KEYS[1]), "timestamp", ARGV[2], "author", ARGV[3], "payload", ARGV[4], "changes", ARGV[5]}
+if tonumber(ARGV[6]) > 0 then
+	redis.call("XADD", KEYS[2], "MAXLEN", ARGV[6], unpack(args))
+else
+	redis.call("XADD", KEYS[2], unpack(args))
+end
+return redis.call("PEXPIRE", KEYS[2], ARGV[1])
+`)
+
+// queues appending the revision to the history, after the version was incremented
+func (c RedisCartConfig) queueHistory(ctx context.Context, pipe redis.Pipeliner, cartID string, changes []QuantityChange) {
+	audit := updateAuditFromContext(ctx)
+	// marshaling quantity changes cannot fail
+	payload, _ := json.Marshal(changes)
+	keys := []string{cartVersion(c.cartKey(cartID)), cartHistory(c.cartKey(cartID))}
+	// EVALSHA could fail for want of the script once the transaction is
+	// committed, too late to fall back to EVAL as Run does
+	appendCartRevisionScript.Eval(ctx, pipe, keys, c.historyTTL().Milliseconds(), hlcWallTime(c.Clock()), string(audit.Author), string(audit.Payload), payload, c.HistoryMaxLen)
+}
+
+func cartRevisionFromMessage(message redis.XMessage) (CartRevision, error) {
+	value := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+
+	revision := CartRevision{ID: message.ID, Author: DinerID(value("author"))}
+	var err error
+	if revision.Version, err = strconv.ParseInt(value("version"), 10, 64); err != nil {
+		return CartRevision{}, fmt.Errorf("invalid version of cart revision %s: %w", message.ID, err)
+	}
+	timestamp, err := strconv.ParseInt(value("timestamp"), 10, 64)
+	if err != nil {
+		return CartRevision{}, fmt.Errorf("invalid timestamp of cart revision %s: %w", message.ID, err)
+	}
+	revision.Timestamp = time.Unix(0, timestamp*int64(time.Millisecond))
+	if payload := value("payload"); payload != "" {
+		revision.Payload = json.RawMessage(payload)
+	}
+	if err := json.Unmarshal([]byte(value("changes")), &revision.Changes); err != nil {
+		return CartRevision{}, fmt.Errorf("invalid quantity changes of cart revision %s: %w", message.ID, err)
+	}
+
+	return revision, nil
+}
+
+// CartHistoryReader reads the history of carts, and carts as they were
+type CartHistoryReader interface {
+	ReadCartHistoryWithContext(context.Context, string, string, int64) ([]CartRevision, error)
+	ReadCartAtVersionWithContext(context.Context, string, int64) (Cart, error)
+	ReadCartAtTimeWithContext(context.Context, string, time.Time) (Cart, error)
+}
+
+// reads up to count revisions of the cart, newest first, starting with those
+// before the revision of the given ID or with the newest if it is empty
+func (r *RedisCartReader) ReadCartHistoryWithContext(ctx context.Context, cartID string, before string, count int64) ([]CartRevision, error) {
+	start := "+"
+	if before != "" {
+		// the range includes the revision it starts from, which is dropped
+		start = before
+		count++
+	}
+
+	messages, err := r.client.XRevRangeN(ctx, cartHistory(r.config.cartKey(cartID)), start, "-", count).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error getting cart history from redis: %w", unavailable(ctx, err))
+	}
+
+	revisions := make([]CartRevision, 0, len(messages))
+	for _, message := range messages {
+		if message.ID == before {
+			continue
+		}
+		revision, err := cartRevisionFromMessage(message)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshaling cart history from redis: %w: %v", ErrCorruptCart, err)
+		}
+		revisions = append(revisions, revision)
+	}
+	if before != "" && int64(len(revisions)) == count {
+		revisions = revisions[:count-1]
+	}
+
+	return revisions, nil
+}
+
+func (r *RedisCartReader) ReadCartAtVersionWithContext(ctx context.Context, cartID string, version int64) (Cart, error) {
+	return r.rebuildCart(ctx, cartID, version, time.Time{})
+}
+
+// the cart as of the latest revision at or before the time,
+// as it was to begin with if there was none
+func (r *RedisCartReader) ReadCartAtTimeWithContext(ctx context.Context, cartID string, at time.Time) (Cart, error) {
+	return r.rebuildCart(ctx, cartID, anyVersion, at)
+}
+
+// how many revisions are undone at a time
+const rebuildPageSize = 100
+
+// undoes the revisions of the cart, newest first, until it is back at the
+// version, or if anyVersion, until the revision it is at was made by the time
+func (r *RedisCartReader) rebuildCart(ctx context.Context, cartID string, version int64, at time.Time) (Cart, error) {
+	cart, err := r.ReadCartWithContext(ctx, cartID)
+	if err != nil {
+		return Cart{}, err
+	}
+	if cart.Version < version {
+		return Cart{}, fmt.Errorf("error rebuilding cart at version %d: %w", version, ErrRevisionNotFound)
+	}
+	fields := cartFields(&cart)
+
+	before := ""
+	for cart.Version > 0 && cart.Version != version {
+		revisions, err := r.ReadCartHistoryWithContext(ctx, cartID, before, rebuildPageSize)
+		if err != nil {
+			return Cart{}, err
+		}
+		for _, revision := range revisions {
+			// written since the cart was read
+			if revision.Version > cart.Version {
+				continue
+			}
+			// a revision is missing, expired with the history or of another cart by the same ID
+			if revision.Version != cart.Version {
+				return Cart{}, fmt.Errorf("error rebuilding cart from version %d: %w", cart.Version, ErrRevisionNotFound)
+			}
+			if version == anyVersion && !revision.Timestamp.After(at) {
+				return rebuiltCart(cartID, cart.Version, fields), nil
+			}
+
+			for _, change := range revision.Changes {
+				field := cartField(change.ItemID, change.DinerID)
+				if change.Before == 0 {
+					delete(fields, field)
+				} else {
+					fields[field] = change.Before
+				}
+			}
+			cart.Version--
+			if cart.Version == 0 || cart.Version == version {
+				break
+			}
+		}
+		if cart.Version == 0 || cart.Version == version {
+			break
+		}
+		if len(revisions) < rebuildPageSize {
+			return Cart{}, fmt.Errorf("error rebuilding cart from version %d: %w", cart.Version, ErrRevisionNotFound)
+		}
+		before = revisions[len(revisions)-1].ID
+	}
+
+	return rebuiltCart(cartID, cart.Version, fields), nil
+}
+
+func rebuiltCart(cartID string, version int64, fields map[string]int) Cart {
+	cart := NewCart(cartID)
+	cart.Version = version
+	for field, quantity := range fields {
+		// fields that cannot be parsed are never written in the first place
+		itemID, dinerID, _ := parseCartField(field)
+		if _, ok := cart.CartDetails[itemID]; !ok {
+			cart.CartDetails[itemID] = make(ItemDetails)
+		}
+		cart.CartDetails[itemID][dinerID] = quantity
+	}
+
+	return cart
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// writes three revisions of the cart, each by a diner of its own
+func mustWriteRevisions(t *testing.T, write func(*testing.T, context.Context, []RedisCartOption, string, Cart), options []RedisCartOption, cartID string) {
+	for index, updates := range []Cart{
+		{CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}, "drink": {"diner1": 1}}},
+		{CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 3, "diner2": 2}, "drink": {}}},
+		{CartDetails: map[ItemID]ItemDetails{"fries": {"diner2": 1}}},
+	} {
+		ctx := WithUpdateAudit(context.Background(), UpdateAudit{
+			Author:  DinerID("diner" + strconv.Itoa(index+1)),
+			Payload: json.RawMessage(`{"revision":` + strconv.Itoa(index+1) + `}`),
+		})
+		write(t, ctx, options, cartID, updates)
+	}
+}
+
+func TestCartWritesAreRecordedInHistory(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, writer := range cartWriters {
+		t.Run(writer.name, func(t *testing.T) {
+			options := []RedisCartOption{WithClock(func() time.Time { return now })}
+			cartID := uuid.NewV4().String()
+			mustWriteRevisions(t, writer.write, options, cartID)
+
+			revisions, err := MustRedisCartReader(MustRedisTestClient()).ReadCartHistoryWithContext(context.Background(), cartID, "", 10)
+			require.NoError(t, err)
+			require.Len(t, revisions, 3)
+			for index, revision := range revisions {
+				require.Equal(t, int64(3-index), revision.Version)
+				require.Equal(t, DinerID("diner"+strconv.Itoa(3-index)), revision.Author)
+				require.JSONEq(t, `{"revision":`+strconv.Itoa(3-index)+`}`, string(revision.Payload))
+				require.True(t, now.Equal(revision.Timestamp))
+			}
+			require.Equal(t, []QuantityChange{{ItemID: "fries", DinerID: "diner2", Before: 0, After: 1}}, revisions[0].Changes)
+			require.Equal(t, []QuantityChange{
+				{ItemID: "drink", DinerID: "diner1", Before: 1, After: 0},
+				{ItemID: "food", DinerID: "diner1", Before: 1, After: 3},
+			}, revisions[1].Changes)
+			require.Equal(t, []QuantityChange{
+				{ItemID: "drink", DinerID: "diner1", Before: 0, After: 1},
+				{ItemID: "food", DinerID: "diner1", Before: 0, After: 1},
+				{ItemID: "food", DinerID: "diner2", Before: 0, After: 2},
+			}, revisions[2].Changes)
+		})
+	}
+}
+
+func TestUpdatesWithoutAuditAreRecordedInHistoryAnonymously(t *testing.T) {
+	cartID := uuid.NewV4().String()
+	cartWriters[0].write(t, context.Background(), nil, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1}}})
+
+	revisions, err := MustRedisCartReader(MustRedisTestClient()).ReadCartHistoryWithContext(context.Background(), cartID, "", 10)
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	require.Empty(t, revisions[0].Author)
+	require.Nil(t, revisions[0].Payload)
+}
+
+func TestCartHistoryIsPaginated(t *testing.T) {
+	cartID := uuid.NewV4().String()
+	for quantity := 1; quantity <= 5; quantity++ {
+		cartWriters[0].write(t, context.Background(), nil, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": quantity}}})
+	}
+	reader := MustRedisCartReader(MustRedisTestClient())
+
+	var versions []int64
+	before := ""
+	for page := 0; page < 3; page++ {
+		revisions, err := reader.ReadCartHistoryWithContext(context.Background(), cartID, before, 2)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(revisions), 2)
+		for _, revision := range revisions {
+			versions = append(versions, revision.Version)
+			before = revision.ID
+		}
+	}
+	require.Equal(t, []int64{5, 4, 3, 2, 1}, versions)
+
+	revisions, err := reader.ReadCartHistoryWithContext(context.Background(), cartID, before, 2)
+	require.NoError(t, err)
+	require.Empty(t, revisions)
+}
+
+func TestCartHistoryExpiresWithCartUnlessGivenTTL(t *testing.T) {
+	client := MustRedisTestClient()
+	for _, writer := range cartWriters {
+		t.Run(writer.name, func(t *testing.T) {
+			cartID := uuid.NewV4().String()
+			writer.write(t, context.Background(), []RedisCartOption{WithCartTTL(time.Minute)}, cartID, NewCart(""))
+			ttl, err := client.PTTL(context.Background(), cartHistory(cartID)).Result()
+			require.NoError(t, err)
+			require.InDelta(t, float64(time.Minute), float64(ttl), float64(time.Second))
+
+			writer.write(t, context.Background(), []RedisCartOption{WithCartTTL(time.Minute), WithHistoryTTL(time.Hour)}, cartID, NewCart(""))
+			ttl, err = client.PTTL(context.Background(), cartHistory(cartID)).Result()
+			require.NoError(t, err)
+			require.InDelta(t, float64(time.Hour), float64(ttl), float64(time.Second))
+		})
+	}
+}
+
+func TestCartHistoryIsTrimmedToMaxLen(t *testing.T) {
+	for _, writer := range cartWriters {
+		t.Run(writer.name, func(t *testing.T) {
+			options := []RedisCartOption{WithHistoryMaxLen(2)}
+			cartID := uuid.NewV4().String()
+			mustWriteRevisions(t, writer.write, options, cartID)
+			reader := MustRedisCartReader(MustRedisTestClient(), options...)
+
+			revisions, err := reader.ReadCartHistoryWithContext(context.Background(), cartID, "", 10)
+			require.NoError(t, err)
+			require.Len(t, revisions, 2)
+			require.Equal(t, int64(3), revisions[0].Version)
+			require.Equal(t, int64(2), revisions[1].Version)
+
+			cart, err := reader.ReadCartAtVersionWithContext(context.Background(), cartID, 1)
+			require.NoError(t, err)
+			require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}, "drink": {"diner1": 1}}, cart.CartDetails)
+			_, err = reader.ReadCartAtVersionWithContext(context.Background(), cartID, 0)
+			require.True(t, errors.Is(err, ErrRevisionNotFound), "%v", err)
+		})
+	}
+}
+
+func TestCartHistoryOutlivingCartIsReadButNotRebuilt(t *testing.T) {
+	client := MustRedisTestClient()
+	for _, writer := range cartWriters {
+		t.Run(writer.name, func(t *testing.T) {
+			options := []RedisCartOption{WithCartTTL(time.Minute), WithHistoryTTL(time.Hour)}
+			cartID := uuid.NewV4().String()
+			mustWriteRevisions(t, writer.write, options, cartID)
+			// as if the cart expired
+			require.NoError(t, client.Del(context.Background(), cartID, cartClocks(cartID), cartVersion(cartID)).Err())
+			reader := MustRedisCartReader(client, options...)
+
+			revisions, err := reader.ReadCartHistoryWithContext(context.Background(), cartID, "", 10)
+			require.NoError(t, err)
+			require.Len(t, revisions, 3)
+			_, err = reader.ReadCartAtVersionWithContext(context.Background(), cartID, 2)
+			require.True(t, errors.Is(err, ErrRevisionNotFound), "%v", err)
+
+			writer.write(t, context.Background(), options, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"fries": {"diner3": 1}}})
+			revisions, err = reader.ReadCartHistoryWithContext(context.Background(), cartID, "", 10)
+			require.NoError(t, err)
+			require.Len(t, revisions, 4)
+			require.Equal(t, int64(1), revisions[0].Version)
+			for version, details := range []map[ItemID]ItemDetails{{}, {"fries": {"diner3": 1}}} {
+				cart, err := reader.ReadCartAtVersionWithContext(context.Background(), cartID, int64(version))
+				require.NoError(t, err)
+				require.Equal(t, int64(version), cart.Version)
+				require.Equal(t, details, cart.CartDetails)
+			}
+		})
+	}
+}
+
+func TestCartsAreRebuiltAtVersion(t *testing.T) {
+	for _, writer := range cartWriters {
+		t.Run(writer.name, func(t *testing.T) {
+			cartID := uuid.NewV4().String()
+			mustWriteRevisions(t, writer.write, nil, cartID)
+			reader := MustRedisCartReader(MustRedisTestClient())
+
+			for version, details := range []map[ItemID]ItemDetails{
+				{},
+				{"food": {"diner1": 1, "diner2": 2}, "drink": {"diner1": 1}},
+				{"food": {"diner1": 3, "diner2": 2}},
+				{"food": {"diner1": 3, "diner2": 2}, "fries": {"diner2": 1}},
+			} {
+				cart, err := reader.ReadCartAtVersionWithContext(context.Background(), cartID, int64(version))
+				require.NoError(t, err)
+				require.Equal(t, int64(version), cart.Version)
+				require.Equal(t, cartID, cart.CartID)
+				require.Equal(t, details, cart.CartDetails)
+			}
+
+			_, err := reader.ReadCartAtVersionWithContext(context.Background(), cartID, 4)
+			require.True(t, errors.Is(err, ErrRevisionNotFound), "%v", err)
+		})
+	}
+}
+
+func TestCartsAreRebuiltAtTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	cartID := uuid.NewV4().String()
+	for quantity := 1; quantity <= 3; quantity++ {
+		cartWriters[0].write(t, context.Background(), []RedisCartOption{WithClock(clock)}, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": quantity}}})
+		now = now.Add(time.Minute)
+	}
+	reader := MustRedisCartReader(MustRedisTestClient())
+	start := time.Unix(1700000000, 0)
+
+	cart, err := reader.ReadCartAtTimeWithContext(context.Background(), cartID, start.Add(-time.Second))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), cart.Version)
+	require.Empty(t, cart.CartDetails)
+
+	cart, err = reader.ReadCartAtTimeWithContext(context.Background(), cartID, start.Add(90*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), cart.Version)
+	require.Equal(t, 2, cart.CartDetails["food"]["diner"])
+
+	cart, err = reader.ReadCartAtTimeWithContext(context.Background(), cartID, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), cart.Version)
+	require.Equal(t, 3, cart.CartDetails["food"]["diner"])
+}
+
+func TestCartsAreNotRebuiltBeyondTheirHistory(t *testing.T) {
+	client := MustRedisTestClient()
+	cartID := uuid.NewV4().String()
+	for quantity := 1; quantity <= 3; quantity++ {
+		cartWriters[0].write(t, context.Background(), nil, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": quantity}}})
+	}
+	// as if the history had expired before the cart and been started afresh
+	require.NoError(t, client.XTrim(context.Background(), cartHistory(cartID), 1).Err())
+	reader := MustRedisCartReader(client)
+
+	cart, err := reader.ReadCartAtVersionWithContext(context.Background(), cartID, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, cart.CartDetails["food"]["diner"])
+	_, err = reader.ReadCartAtVersionWithContext(context.Background(), cartID, 1)
+	require.True(t, errors.Is(err, ErrRevisionNotFound), "%v", err)
+	_, err = reader.ReadCartAtTimeWithContext(context.Background(), cartID, time.Unix(0, 0))
+	require.True(t, errors.Is(err, ErrRevisionNotFound), "%v", err)
+}
+
+func TestLegacyCartsAreRebuiltAsTheyWereBeforeMigrating(t *testing.T) {
+	client := MustRedisTestClient()
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1}}}, true)
+	cartWriters[0].write(t, context.Background(), nil, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": 2}}})
+
+	cart, err := MustRedisCartReader(client).ReadCartAtVersionWithContext(context.Background(), cartID, 0)
+	require.NoError(t, err)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 1}}, cart.CartDetails)
+}
@@ -2,48 +2,71 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
-// TODO: define as you best see fit
-var readTimeout = 2 * time.Second
-var updateTimeout = 2 * time.Second
-
 func main() {
-	// TODO: read from env/config file as you best see fit
-	client, err := NewRedisClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+	config, printConfig, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	if printConfig {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(config.Redacted()); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	// TODO: replace with signal handling context
-	ctx := context.TODO()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	cartUpdater := NewRedisCartUpdater(client)
-	cartReader := NewRedisCartReader(client)
+	if err := run(ctx, config); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// TODO: use a router of your choice and path variables instead of reqeust params
-	http.HandleFunc("/read_cart", func(w http.ResponseWriter, r *http.Request) {
-		// TODO: handle with signal context
-		ctx, _ := context.WithTimeout(ctx, readTimeout)
-		ReadCartWithContext(ctx, cartReader, w, r)
-	})
-	http.HandleFunc("/update_cart", func(w http.ResponseWriter, r *http.Request) {
-		// TODO: handle with signal context
-		ctx, _ := context.WithTimeout(ctx, readTimeout)
-		UpdateCartWithContext(ctx, cartUpdater, w, r)
-	})
+// serves carts until ctx is cancelled and everything has shut down
+func run(ctx context.Context, config Config) error {
+	redisOptions, err := config.RedisOptions()
+	if err != nil {
+		return err
+	}
+	client, err := NewRedisClient(redisOptions)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	cartUpdater, err := NewCartUpdater(client, config.Cart.UpdateStrategy, WithConfig(config.RedisCartConfig()))
+	if err != nil {
+		return err
+	}
+	cartReader, err := NewRedisCartReader(client, WithConfig(config.RedisCartConfig()))
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", config.HTTP.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", config.HTTP.Addr, err)
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	return Serve(ctx, listener, config.HTTP, config.RedisCartConfig().Limits, cartUpdater, cartReader)
 }
 
 func NewRedisClient(options *redis.Options) (*redis.Client, error) {
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"log"
+	"testing"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
 )
 
 func MustRedisTestClient() *redis.Client {
@@ -19,3 +24,65 @@ func MustRedisTestClient() *redis.Client {
 
 	return client
 }
+
+func MustRedisCartUpdater(client *redis.Client, options ...RedisCartOption) *RedisCartUpdater {
+	updater, err := NewRedisCartUpdater(client, options...)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	return updater
+}
+
+func MustRedisOptimisticCartUpdater(client *redis.Client, options ...RedisCartOption) *RedisOptimisticCartUpdater {
+	updater, err := NewRedisOptimisticCartUpdater(client, options...)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	return updater
+}
+
+func MustRedisScriptCartMerger(client *redis.Client, options ...RedisCartOption) *RedisScriptCartMerger {
+	merger, err := NewRedisScriptCartMerger(client, options...)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	return merger
+}
+
+func MustRedisCartReader(client *redis.Client, options ...RedisCartOption) *RedisCartReader {
+	reader, err := NewRedisCartReader(client, options...)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	return reader
+}
+
+// stores the cart as is in either layout, bypassing any updater
+func mustStoreCart(t *testing.T, client *redis.Client, cart Cart, legacy bool) {
+	ctx := context.Background()
+	if legacy {
+		serializedData, err := json.Marshal(cart)
+		require.NoError(t, err)
+		require.NoError(t, client.Set(ctx, cart.CartID, serializedData, time.Minute).Err())
+		return
+	}
+
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		DefaultRedisCartConfig().queueCartWrite(ctx, pipe, cart.CartID, cartSnapshot{}, false, &cart)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func MustRedisCartChangeReader(client *redis.Client, group string, consumer string, options ...RedisCartOption) *RedisCartChangeReader {
+	reader, err := NewRedisCartChangeReader(client, group, consumer, options...)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	return reader
+}
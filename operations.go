@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+)
+
+type OperationType string
+
+const (
+	// adds the amount to the quantity of the item for the diner
+	IncrementOperation OperationType = "inc"
+	// subtracts the amount, removing the diner from the item at zero
+	DecrementOperation OperationType = "dec"
+	// sets the quantity to the amount, removing the diner from the item at zero
+	SetOperation OperationType = "set"
+	// removes the diner from the item, or the item if no diner is given
+	RemoveOperation OperationType = "remove"
+)
+
+// Operation changes a quantity relative to what it is at the time of the
+// update, so that concurrent operations on the same quantity all count
+type Operation struct {
+	Op      OperationType `json:"op"`
+	ItemID  ItemID        `json:"item_id"`
+	DinerID DinerID       `json:"diner_id,omitempty"`
+	Amount  int           `json:"amount,omitempty"`
+}
+
+// OperationResult is the quantity an operation left the item at for the
+// diner, or for a removed item the zero quantity it was left at for all
+type OperationResult struct {
+	Operation
+	Quantity int `json:"quantity"`
+}
+
+// validates operations independently of any cart, reporting
+// every invalid field of every operation by its index
+func validateOperations(operations []Operation) error {
+	var fields []FieldError
+	for index, operation := range operations {
+		field := fmt.Sprintf("operations[%d]", index)
+		switch operation.Op {
+		case IncrementOperation, DecrementOperation:
+			if operation.Amount <= 0 {
+				fields = append(fields, FieldError{Field: field + ".amount", Message: "must be positive"})
+			}
+		case SetOperation:
+			if operation.Amount < 0 {
+				fields = append(fields, FieldError{Field: field + ".amount", Message: "must not be negative"})
+			}
+		case RemoveOperation:
+			if operation.Amount != 0 {
+				fields = append(fields, FieldError{Field: field + ".amount", Message: "must not be given"})
+			}
+		default:
+			fields = append(fields, FieldError{Field: field + ".op", Message: "must be one of inc, dec, set or remove"})
+		}
+
+		if operation.ItemID == "" {
+			fields = append(fields, FieldError{Field: field + ".item_id", Message: "must not be empty"})
+		}
+		if operation.DinerID == "" && operation.Op != RemoveOperation {
+			fields = append(fields, FieldError{Field: field + ".diner_id", Message: "must not be empty"})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+
+	return nil
+}
+
+// applies the operations in order with the removal semantics
+// of compareAndUpdateCart, decrements stopping at zero
+func applyOperations(cart *Cart, operations []Operation) []OperationResult {
+	results := make([]OperationResult, 0, len(operations))
+	for _, operation := range operations {
+		if operation.Op == RemoveOperation && operation.DinerID == "" {
+			compareAndUpdateCart(cart, Cart{CartID: cart.CartID, CartDetails: map[ItemID]ItemDetails{operation.ItemID: {}}})
+			results = append(results, OperationResult{Operation: operation})
+			continue
+		}
+
+		quantity := cart.CartDetails[operation.ItemID][operation.DinerID]
+		switch operation.Op {
+		case IncrementOperation:
+			quantity += operation.Amount
+		case DecrementOperation:
+			quantity -= operation.Amount
+			if quantity < 0 {
+				quantity = 0
+			}
+		case SetOperation:
+			quantity = operation.Amount
+		case RemoveOperation:
+			quantity = 0
+		}
+
+		compareAndUpdateCart(cart, Cart{CartID: cart.CartID, CartDetails: map[ItemID]ItemDetails{operation.ItemID: {operation.DinerID: quantity}}})
+		results = append(results, OperationResult{Operation: operation, Quantity: quantity})
+	}
+
+	return results
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOperationsAcceptsValidOperations(t *testing.T) {
+	require.NoError(t, validateOperations([]Operation{
+		{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 1},
+		{Op: DecrementOperation, ItemID: "food", DinerID: "diner", Amount: 1},
+		{Op: SetOperation, ItemID: "food", DinerID: "diner", Amount: 0},
+		{Op: RemoveOperation, ItemID: "food", DinerID: "diner"},
+		{Op: RemoveOperation, ItemID: "food"},
+	}))
+	require.NoError(t, validateOperations(nil))
+}
+
+func TestValidateOperationsReportsEveryInvalidFieldOfEveryOperation(t *testing.T) {
+	err := validateOperations([]Operation{
+		{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 1},
+		{Op: "double", ItemID: "food", DinerID: "diner"},
+		{Op: IncrementOperation, ItemID: "", DinerID: "", Amount: 0},
+		{Op: DecrementOperation, ItemID: "food", DinerID: "diner", Amount: -1},
+		{Op: SetOperation, ItemID: "food", DinerID: "diner", Amount: -1},
+		{Op: RemoveOperation, ItemID: "food", Amount: 1},
+	})
+
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	require.Equal(t, []FieldError{
+		{Field: "operations[1].op", Message: "must be one of inc, dec, set or remove"},
+		{Field: "operations[2].amount", Message: "must be positive"},
+		{Field: "operations[2].item_id", Message: "must not be empty"},
+		{Field: "operations[2].diner_id", Message: "must not be empty"},
+		{Field: "operations[3].amount", Message: "must be positive"},
+		{Field: "operations[4].amount", Message: "must not be negative"},
+		{Field: "operations[5].amount", Message: "must not be given"},
+	}, validationErr.Fields)
+}
+
+func TestApplyOperations(t *testing.T) {
+	for _, testCase := range []struct {
+		name       string
+		current    map[ItemID]ItemDetails
+		operations []Operation
+		expected   map[ItemID]ItemDetails
+		quantities []int
+	}{
+		{
+			name:       "increments quantities from zero",
+			current:    nil,
+			operations: []Operation{{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 2}},
+			expected:   map[ItemID]ItemDetails{"food": {"diner": 2}},
+			quantities: []int{2},
+		},
+		{
+			name:       "increments existing quantities",
+			current:    map[ItemID]ItemDetails{"food": {"diner": 1}},
+			operations: []Operation{{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 1}},
+			expected:   map[ItemID]ItemDetails{"food": {"diner": 2}},
+			quantities: []int{2},
+		},
+		{
+			name:       "decrements quantities down to removal at most",
+			current:    map[ItemID]ItemDetails{"food": {"diner1": 3, "diner2": 1}},
+			operations: []Operation{{Op: DecrementOperation, ItemID: "food", DinerID: "diner1", Amount: 1}, {Op: DecrementOperation, ItemID: "food", DinerID: "diner2", Amount: 5}},
+			expected:   map[ItemID]ItemDetails{"food": {"diner1": 2}},
+			quantities: []int{2, 0},
+		},
+		{
+			name:       "sets quantities",
+			current:    map[ItemID]ItemDetails{"food": {"diner": 3}},
+			operations: []Operation{{Op: SetOperation, ItemID: "food", DinerID: "diner", Amount: 1}, {Op: SetOperation, ItemID: "drink", DinerID: "diner", Amount: 2}},
+			expected:   map[ItemID]ItemDetails{"food": {"diner": 1}, "drink": {"diner": 2}},
+			quantities: []int{1, 2},
+		},
+		{
+			name:       "removes diners from items",
+			current:    map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 1}, "drink": {"diner1": 1}},
+			operations: []Operation{{Op: RemoveOperation, ItemID: "food", DinerID: "diner1"}, {Op: SetOperation, ItemID: "drink", DinerID: "diner1", Amount: 0}},
+			expected:   map[ItemID]ItemDetails{"food": {"diner2": 1}},
+			quantities: []int{0, 0},
+		},
+		{
+			name:       "removes items for every diner",
+			current:    map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 1}, "drink": {"diner1": 1}},
+			operations: []Operation{{Op: RemoveOperation, ItemID: "food"}},
+			expected:   map[ItemID]ItemDetails{"drink": {"diner1": 1}},
+			quantities: []int{0},
+		},
+		{
+			name:    "applies operations in order",
+			current: nil,
+			operations: []Operation{
+				{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 1},
+				{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 1},
+				{Op: RemoveOperation, ItemID: "food"},
+				{Op: IncrementOperation, ItemID: "food", DinerID: "diner", Amount: 1},
+			},
+			expected:   map[ItemID]ItemDetails{"food": {"diner": 1}},
+			quantities: []int{1, 2, 0, 1},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			cart := NewCart("cart")
+			for itemID, itemDetails := range copyCartDetails(testCase.current) {
+				cart.CartDetails[itemID] = itemDetails
+			}
+
+			results := applyOperations(&cart, testCase.operations)
+
+			require.Equal(t, testCase.expected, cart.CartDetails)
+			require.Len(t, results, len(testCase.operations))
+			for index, result := range results {
+				require.Equal(t, testCase.operations[index], result.Operation)
+				require.Equal(t, testCase.quantities[index], result.Quantity)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrTooManyConflicts is returned when an optimistic update keeps
+// losing to concurrent updates of the same cart beyond its retry policy
+var ErrTooManyConflicts = errors.New("too many conflicting updates")
+
+// RetryPolicy bounds how often and how quickly an optimistic update
+// is retried after losing to a concurrent update of the same cart
+type RetryPolicy struct {
+	MaxRetries  int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+// retries within a few hundred milliseconds at most, well within the time
+// a request is given, backing off from about the time a round trip to redis
+// takes to an interval long enough for a burst of diners to have saved
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:  10,
+	BaseBackoff: 5 * time.Millisecond,
+	MaxBackoff:  100 * time.Millisecond,
+}
+
+// full jitter over an exponentially growing window so that
+// conflicting updaters spread out instead of colliding again
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	window := p.MaxBackoff
+	if attempt < 32 && p.BaseBackoff<<uint(attempt) < p.MaxBackoff {
+		window = p.BaseBackoff << uint(attempt)
+	}
+	if window <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(window) + 1))
+}
+
+// RedisOptimisticCartUpdater updates carts without taking a lock, reading
+// under WATCH and committing with MULTI/EXEC, retrying when another update
+// of the cart commits in between. It must not be mixed with RedisCartUpdater
+// on the same carts since neither honors the other's protocol.
+type RedisOptimisticCartUpdater struct {
+	client *redis.Client
+	config RedisCartConfig
+}
+
+func NewRedisOptimisticCartUpdater(client *redis.Client, options ...RedisCartOption) (*RedisOptimisticCartUpdater, error) {
+	config, err := newRedisCartConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisOptimisticCartUpdater{
+		client: client,
+		config: config,
+	}, nil
+}
+
+func (r *RedisOptimisticCartUpdater) UpdateCartWithContext(ctx context.Context, cartID string, updaterFunc func(*Cart) *Cart) error {
+	return r.updateCart(ctx, cartID, anyVersion, updaterFunc)
+}
+
+// UpdateCartIfVersionWithContext fails with ErrVersionMismatch if the cart
+// is not at the given version, without retrying or calling updaterFunc
+func (r *RedisOptimisticCartUpdater) UpdateCartIfVersionWithContext(ctx context.Context, cartID string, version int64, updaterFunc func(*Cart) *Cart) error {
+	return r.updateCart(ctx, cartID, version, updaterFunc)
+}
+
+func (r *RedisOptimisticCartUpdater) updateCart(ctx context.Context, cartID string, version int64, updaterFunc func(*Cart) *Cart) error {
+	cartKey := r.config.cartKey(cartID)
+	for attempt := 0; ; attempt++ {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			cart, legacy, err := r.config.loadCart(ctx, tx, cartID)
+			if errors.Is(err, ErrCorruptCart) {
+				return fmt.Errorf("error unmarshaling existing cart from redis: %w", err)
+			}
+			if err != nil {
+				return fmt.Errorf("error getting existing cart from redis: %w", unavailable(ctx, err))
+			}
+			if version != anyVersion && cart.Version != version {
+				return fmt.Errorf("error updating cart at version %d: %w", cart.Version, ErrVersionMismatch)
+			}
+
+			stored := snapshotCart(&cart)
+			updatedCart := updaterFunc(&cart)
+			if updatedCart == nil {
+				return ErrUpdateAborted
+			}
+			if err := updatedCart.Validate(r.config.Limits); err != nil {
+				return err
+			}
+
+			var savedVersion *redis.IntCmd
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				savedVersion = r.config.queueCartWrite(ctx, pipe, cartID, stored, legacy, updatedCart)
+
+				return nil
+			})
+			if err != nil && err != redis.TxFailedErr {
+				return fmt.Errorf("error saving cart in redis: %w", unavailable(ctx, err))
+			}
+			if err == nil {
+				updatedCart.Version = savedVersion.Val()
+				// watchers catch up on the next event or when they resume,
+				// so failing to publish does not fail an update that was saved
+				_ = r.config.publishCart(ctx, r.client, cartID, updatedCart)
+			}
+
+			return err
+		}, cartKey, cartClocks(cartKey), cartVersion(cartKey))
+
+		if err == nil {
+			return nil
+		}
+		if err != redis.TxFailedErr {
+			return fmt.Errorf("error updating cart optimistically: %w", unavailable(ctx, err))
+		}
+		if attempt >= r.config.RetryPolicy.MaxRetries {
+			return fmt.Errorf("error saving cart in redis: %w", ErrTooManyConflicts)
+		}
+
+		timer := time.NewTimer(r.config.RetryPolicy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("timed out retrying conflicting update: %w", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisOptimisticUpdateCartWithContextReturnsErrorIfErrorRetrievingExistingCartFromRedis(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.LPush(ctx, cartID, "irrelevant").Result()
+	require.NoError(t, err)
+	defer func() {
+		client.Del(ctx, cartID).Result()
+	}()
+
+	err = updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart })
+
+	require.Error(t, err)
+	require.Regexp(t, "error getting existing cart", err.Error())
+}
+
+func TestRedisOptimisticUpdateCartWithContextReturnsErrorIfExistingCartIsInvalidJSON(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.Set(ctx, cartID, "totally not JSON", 100*time.Millisecond).Result()
+	require.NoError(t, err)
+
+	err = updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart })
+
+	require.Error(t, err)
+	require.Regexp(t, "error unmarshaling existing cart", err.Error())
+}
+
+func TestRedisOptimisticUpdateCartWithContextSavesCart(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"] = map[DinerID]int{"diner": 1}
+		return cart
+	})
+
+	require.NoError(t, err)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, cartID, cart.CartID)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+}
+
+func TestRedisOptimisticUpdateCartWithContextRetriesOnConflictingUpdate(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	attempts := 0
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		attempts++
+		if attempts == 1 {
+			// simulates another diner committing in between our read and write
+			client.Set(ctx, cartID, fmt.Sprintf(`{"cart_id": "%s", "cart_details": {"drink": {"diner2": 1}}}`, cartID), time.Minute)
+		}
+
+		cart.CartDetails["food"] = map[DinerID]int{"diner1": 1}
+		return cart
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner1"])
+	require.Equal(t, 1, cart.CartDetails["drink"]["diner2"])
+}
+
+func TestRedisOptimisticUpdateCartWithContextReturnsErrTooManyConflictsAfterMaxRetries(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client, WithRetryPolicy(RetryPolicy{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	attempts := 0
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		attempts++
+		client.Set(ctx, cartID, fmt.Sprintf(`{"cart_id": "%s"}`, cartID), time.Minute)
+		return cart
+	})
+
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrTooManyConflicts))
+	require.Equal(t, 3, attempts)
+}
+
+func TestRedisOptimisticUpdateCartWithContextReturnsErrorIfContextExpiresWhileRetrying(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client, WithRetryPolicy(RetryPolicy{MaxRetries: 1000, BaseBackoff: time.Second, MaxBackoff: time.Second}))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		client.Set(ctx, cartID, fmt.Sprintf(`{"cart_id": "%s"}`, cartID), time.Minute)
+		return cart
+	})
+
+	require.Error(t, err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRedisOptimisticUpdateCartWithContextMigratesLegacyCartToHash(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1}}}, true)
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"]["diner2"] = 2
+		return cart
+	})
+
+	require.NoError(t, err)
+	fields, err := client.HGetAll(ctx, cartID).Result()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		cartField("food", "diner1"): "1",
+		cartField("food", "diner2"): "2",
+	}, fields)
+}
+
+func TestRetryPolicyBackoffStaysWithinExponentialWindow(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 10, BaseBackoff: time.Millisecond, MaxBackoff: 8 * time.Millisecond}
+
+	for i := 0; i < 100; i++ {
+		require.LessOrEqual(t, int64(policy.backoff(0)), int64(time.Millisecond))
+		require.LessOrEqual(t, int64(policy.backoff(2)), int64(4*time.Millisecond))
+		require.LessOrEqual(t, int64(policy.backoff(40)), int64(8*time.Millisecond))
+		require.GreaterOrEqual(t, int64(policy.backoff(40)), int64(0))
+	}
+}
+
+func TestNewCartUpdaterReturnsUpdaterForStrategy(t *testing.T) {
+	client := MustRedisTestClient()
+
+	updater, err := NewCartUpdater(client, LockingUpdateStrategy)
+	require.NoError(t, err)
+	require.IsType(t, &RedisCartUpdater{}, updater)
+
+	updater, err = NewCartUpdater(client, OptimisticUpdateStrategy)
+	require.NoError(t, err)
+	require.IsType(t, &RedisOptimisticCartUpdater{}, updater)
+
+	updater, err = NewCartUpdater(client, ScriptUpdateStrategy)
+	require.NoError(t, err)
+	require.IsType(t, &RedisScriptCartUpdater{}, updater)
+
+	_, err = NewCartUpdater(client, "pessimistic")
+	require.Error(t, err)
+}
+
+func BenchmarkRedisCartUpdaterHotCart(b *testing.B) {
+	benchmarkHotCartUpdates(b, MustRedisCartUpdater(MustRedisTestClient()))
+}
+
+func BenchmarkRedisOptimisticCartUpdaterHotCart(b *testing.B) {
+	benchmarkHotCartUpdates(b, MustRedisOptimisticCartUpdater(
+		MustRedisTestClient(),
+		WithRetryPolicy(RetryPolicy{MaxRetries: 1000, BaseBackoff: 100 * time.Microsecond, MaxBackoff: 10 * time.Millisecond}),
+	))
+}
+
+// every diner increments their own quantity of a shared item
+// in the same cart, which is the worst case for either strategy
+func benchmarkHotCartUpdates(b *testing.B, updater CartUpdater) {
+	cartID := uuid.NewV4().String()
+	var diners int64
+	var failures int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		diner := DinerID(fmt.Sprintf("diner%d", atomic.AddInt64(&diners, 1)))
+		for pb.Next() {
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+			err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+				if _, ok := cart.CartDetails["food"]; !ok {
+					cart.CartDetails["food"] = make(ItemDetails)
+				}
+				cart.CartDetails["food"][diner]++
+				return cart
+			})
+			cancelFunc()
+			if err != nil {
+				atomic.AddInt64(&failures, 1)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(failures)/float64(b.N), "failures/op")
+}
+
+func TestRedisOptimisticUpdateCartWithContextRejectsInvalidCart(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"] = ItemDetails{"": 1}
+		return cart
+	})
+
+	require.True(t, errors.Is(err, ErrValidation))
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Empty(t, cart.CartDetails)
+}
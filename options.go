@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Serializer encodes carts wherever they are stored as a whole
+// rather than field by field, such as legacy carts
+type Serializer interface {
+	Marshal(Cart) ([]byte, error)
+	Unmarshal([]byte, *Cart) error
+}
+
+type JSONSerializer struct{}
+
+func (JSONSerializer) Marshal(cart Cart) ([]byte, error) {
+	return json.Marshal(cart)
+}
+
+func (JSONSerializer) Unmarshal(data []byte, cart *Cart) error {
+	return json.Unmarshal(data, cart)
+}
+
+// Clock tells the time for everything that is not bound by a context,
+// such as queue deadlines, so that it can be controlled in tests
+type Clock func() time.Time
+
+// RedisCartConfig configures how carts are stored in redis and updated,
+// shared by readers and updaters which must agree on at least the keys
+type RedisCartConfig struct {
+	// prepended to the ID of every cart to give its key
+	KeyPrefix string
+	// carts expire this long after they were last updated
+	CartTTL time.Duration
+	// renewed for the duration of an update if set, see WithLockLease
+	LockLease time.Duration
+	// how long the lock is held given a context without a deadline
+	DefaultLockTTL time.Duration
+	// how long to wait for the lock given a context without a deadline
+	MaxWait time.Duration
+	// how often waiters check for the lock in case a wake up was lost
+	WakeUpInterval time.Duration
+	// how long to spend releasing the lock after an update failed
+	LockReleaseTimeout time.Duration
+	// how optimistic updates are retried
+	RetryPolicy RetryPolicy
+	// which every cart must be within to be saved
+	Limits CartLimits
+	// identifies the writes of this replica of the carts, see WithReplicaID
+	ReplicaID string
+	// the stream every write of a cart is appended to, after the key
+	// prefix, or none if empty, see WithChangeLog
+	ChangeLogKey string
+	// the change log is trimmed to this many of the latest writes if positive
+	ChangeLogMaxLen int64
+	// the history of a cart expires this long after its last update,
+	// or along with the cart if zero, see WithHistoryTTL
+	HistoryTTL time.Duration
+	// the history of a cart is trimmed to this many of its latest revisions
+	// if positive, see WithHistoryMaxLen
+	HistoryMaxLen int64
+	Serializer    Serializer
+	Clock         Clock
+}
+
+// carts live for as long as a meal is being ordered, locks are held for no
+// longer than an update should ever take, and the change log keeps the last
+// 100000 writes across every cart, enough for consumers to catch up after an
+// outage, whereas the history of a cart keeps its last 1000 revisions, far
+// more than a cart is written while ordering
+func DefaultRedisCartConfig() RedisCartConfig {
+	return RedisCartConfig{
+		KeyPrefix:          "",
+		CartTTL:            5 * time.Minute,
+		LockLease:          0,
+		DefaultLockTTL:     10 * time.Second,
+		MaxWait:            10 * time.Second,
+		WakeUpInterval:     1 * time.Second,
+		LockReleaseTimeout: 100 * time.Millisecond,
+		RetryPolicy:        DefaultRetryPolicy,
+		Limits:             DefaultCartLimits(),
+		ChangeLogKey:       "redisync:changes",
+		ChangeLogMaxLen:    100000,
+		HistoryTTL:         0,
+		HistoryMaxLen:      1000,
+		Serializer:         JSONSerializer{},
+		Clock:              time.Now,
+	}
+}
+
+func (c RedisCartConfig) Validate() error {
+	var errs []string
+	if c.CartTTL <= 0 {
+		errs = append(errs, "cart TTL must be positive")
+	}
+	if c.LockLease < 0 {
+		errs = append(errs, "lock lease must not be negative")
+	}
+	// the lease is renewed three times per lease
+	if c.LockLease > 0 && c.LockLease < 3*time.Millisecond {
+		errs = append(errs, "lock lease must be at least 3ms to be renewable")
+	}
+	if c.DefaultLockTTL <= 0 {
+		errs = append(errs, "default lock TTL must be positive")
+	}
+	// fencing tokens only live as long as the cart, so a lock outliving
+	// the cart could see the fencing token counter reset under it
+	if c.LockLease > c.CartTTL || c.DefaultLockTTL > c.CartTTL {
+		errs = append(errs, "lock lease and default lock TTL must not exceed the cart TTL")
+	}
+	if c.MaxWait <= 0 {
+		errs = append(errs, "max wait must be positive")
+	}
+	// which is the resolution of BLPOP
+	if c.WakeUpInterval < time.Second {
+		errs = append(errs, "wake up interval must be at least a second")
+	}
+	if c.LockReleaseTimeout <= 0 {
+		errs = append(errs, "lock release timeout must be positive")
+	}
+	if c.RetryPolicy.MaxRetries < 0 {
+		errs = append(errs, "max retries must not be negative")
+	}
+	if c.RetryPolicy.BaseBackoff < 0 || c.RetryPolicy.MaxBackoff < c.RetryPolicy.BaseBackoff {
+		errs = append(errs, "backoff must not be negative and max backoff must be at least base backoff")
+	}
+	if err := c.Limits.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.ChangeLogMaxLen < 0 {
+		errs = append(errs, "change log max length must not be negative")
+	}
+	if c.HistoryTTL < 0 {
+		errs = append(errs, "history TTL must not be negative")
+	}
+	if c.HistoryMaxLen < 0 {
+		errs = append(errs, "history max length must not be negative")
+	}
+	if c.Serializer == nil {
+		errs = append(errs, "serializer must be set")
+	}
+	if c.Clock == nil {
+		errs = append(errs, "clock must be set")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid redis cart config: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (c RedisCartConfig) cartKey(cartID string) string {
+	return c.KeyPrefix + cartID
+}
+
+type RedisCartOption func(*RedisCartConfig)
+
+// WithConfig replaces the whole config, for when it is loaded from elsewhere
+func WithConfig(config RedisCartConfig) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		*c = config
+	}
+}
+
+func WithKeyPrefix(prefix string) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.KeyPrefix = prefix
+	}
+}
+
+func WithCartTTL(ttl time.Duration) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.CartTTL = ttl
+	}
+}
+
+// WithLockLease holds the lock for a lease of the given length, renewed
+// for as long as the update is in progress, rather than until the
+// deadline of the update, which suits updaters that do slow work
+func WithLockLease(lease time.Duration) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.LockLease = lease
+	}
+}
+
+// WithDefaultLockTTL holds the lock for the given TTL when updating
+// with a context that has no deadline and no lease has been configured
+func WithDefaultLockTTL(ttl time.Duration) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.DefaultLockTTL = ttl
+	}
+}
+
+// WithMaxWait gives up waiting for the lock after the given time
+// when updating with a context that has no deadline
+func WithMaxWait(wait time.Duration) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.MaxWait = wait
+	}
+}
+
+func WithWakeUpInterval(interval time.Duration) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.WakeUpInterval = interval
+	}
+}
+
+func WithLockReleaseTimeout(timeout time.Duration) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.LockReleaseTimeout = timeout
+	}
+}
+
+func WithRetryPolicy(retryPolicy RetryPolicy) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.RetryPolicy = retryPolicy
+	}
+}
+
+func WithCartLimits(limits CartLimits) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.Limits = limits
+	}
+}
+
+// WithReplicaID stamps every write with the given ID, which must differ
+// between the replicas of carts that are merged with one another
+func WithReplicaID(replicaID string) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.ReplicaID = replicaID
+	}
+}
+
+// WithChangeLog appends every write of a cart to the stream of the given key,
+// trimmed to the given number of the latest writes unless zero, or to no
+// stream at all if the key is empty
+func WithChangeLog(key string, maxLen int64) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.ChangeLogKey = key
+		c.ChangeLogMaxLen = maxLen
+	}
+}
+
+// WithHistoryTTL keeps the history of a cart for the given TTL after its last
+// update rather than for as long as the cart, though only its revisions can be
+// read once the cart expired, since versions of the cart expire along with it
+// and carts can only be rebuilt as of a version from the cart as it is
+func WithHistoryTTL(ttl time.Duration) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.HistoryTTL = ttl
+	}
+}
+
+// WithHistoryMaxLen trims the history of a cart to the given number of its
+// latest revisions unless zero, beyond which the cart cannot be rebuilt
+func WithHistoryMaxLen(maxLen int64) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.HistoryMaxLen = maxLen
+	}
+}
+
+func WithSerializer(serializer Serializer) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.Serializer = serializer
+	}
+}
+
+func WithClock(clock Clock) RedisCartOption {
+	return func(c *RedisCartConfig) {
+		c.Clock = clock
+	}
+}
+
+func newRedisCartConfig(options []RedisCartOption) (RedisCartConfig, error) {
+	config := DefaultRedisCartConfig()
+	for _, option := range options {
+		option(&config)
+	}
+
+	return config, config.Validate()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultRedisCartConfigIsValid(t *testing.T) {
+	require.NoError(t, DefaultRedisCartConfig().Validate())
+}
+
+func TestRedisCartConfigValidateRejectsNonsensicalConfigs(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		option RedisCartOption
+	}{
+		{"non positive cart TTL", WithCartTTL(0)},
+		{"negative lock lease", WithLockLease(-time.Second)},
+		{"unrenewable lock lease", WithLockLease(time.Millisecond)},
+		{"lock lease outliving the cart", WithLockLease(time.Hour)},
+		{"default lock TTL outliving the cart", WithDefaultLockTTL(time.Hour)},
+		{"non positive default lock TTL", WithDefaultLockTTL(0)},
+		{"non positive max wait", WithMaxWait(0)},
+		{"sub second wake up interval", WithWakeUpInterval(100 * time.Millisecond)},
+		{"non positive lock release timeout", WithLockReleaseTimeout(0)},
+		{"negative max retries", WithRetryPolicy(RetryPolicy{MaxRetries: -1})},
+		{"max backoff under base backoff", WithRetryPolicy(RetryPolicy{BaseBackoff: time.Second, MaxBackoff: time.Millisecond})},
+		{"non positive cart limits", WithCartLimits(CartLimits{MaxQuantity: 1, MaxItems: 1, MaxDiners: 1})},
+		{"negative history max length", WithHistoryMaxLen(-1)},
+		{"no serializer", WithSerializer(nil)},
+		{"no clock", WithClock(nil)},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := NewRedisCartUpdater(MustRedisTestClient(), testCase.option)
+
+			require.Error(t, err)
+			require.Regexp(t, "invalid redis cart config", err.Error())
+		})
+	}
+}
+
+func TestRedisCartConfigValidateReportsEveryProblem(t *testing.T) {
+	config := DefaultRedisCartConfig()
+	config.CartTTL = 0
+	config.MaxWait = 0
+
+	err := config.Validate()
+
+	require.Error(t, err)
+	require.Regexp(t, "cart TTL", err.Error())
+	require.Regexp(t, "max wait", err.Error())
+}
+
+func TestWithKeyPrefixNamespacesEveryKeyOfTheCart(t *testing.T) {
+	client := MustRedisTestClient()
+	prefix := fmt.Sprintf("%s:", uuid.NewV4().String())
+	updater := MustRedisCartUpdater(client, WithKeyPrefix(prefix))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		exists, err := client.Exists(ctx, lockingSemaphore(prefix+cartID)).Result()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), exists)
+		cart.CartDetails["food"] = map[DinerID]int{"diner": 1}
+		return cart
+	})
+
+	require.NoError(t, err)
+	cart, err := MustRedisCartReader(client, WithKeyPrefix(prefix)).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, cartID, cart.CartID)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+	cart, err = MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Empty(t, cart.CartDetails)
+}
+
+func TestWithCartTTLExpiresCartsAfterTheGivenTTL(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := MustRedisOptimisticCartUpdater(client, WithCartTTL(time.Hour))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"] = map[DinerID]int{"diner": 1}
+		return cart
+	})
+
+	require.NoError(t, err)
+	ttl, err := client.TTL(ctx, cartID).Result()
+	require.NoError(t, err)
+	require.Greater(t, int64(ttl), int64(59*time.Minute))
+}
+
+type failingSerializer struct {
+	JSONSerializer
+}
+
+func (failingSerializer) Unmarshal([]byte, *Cart) error {
+	return fmt.Errorf("failing serializer")
+}
+
+func TestWithSerializerDecodesLegacyCartsWithTheGivenSerializer(t *testing.T) {
+	client := MustRedisTestClient()
+	reader := MustRedisCartReader(client, WithSerializer(failingSerializer{}))
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID}, true)
+
+	_, err := reader.ReadCartWithContext(context.Background(), cartID)
+
+	require.Error(t, err)
+	require.Regexp(t, "failing serializer", err.Error())
+}
+
+func TestWithClockTimesQueueDeadlinesWithTheGivenClock(t *testing.T) {
+	client := MustRedisTestClient()
+	// waiters queued by an updater whose clock is an hour behind look
+	// like they died waiting to an updater with an accurate clock
+	laggingUpdater := MustRedisCartUpdater(client, WithClock(func() time.Time { return time.Now().Add(-time.Hour) }))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+	_, err := client.SetNX(ctx, lockingSemaphore(cartID), semaphoreToken, time.Minute).Result()
+	require.NoError(t, err)
+	go laggingUpdater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart })
+	defer client.Del(context.Background(), lockingSemaphore(cartID))
+	require.Eventually(t, func() bool {
+		return client.ZCard(ctx, waitingQueue(cartID)).Val() == 1
+	}, time.Second, time.Millisecond)
+
+	members, err := client.ZRangeWithScores(ctx, waitingDeadlines(cartID), 0, -1).Result()
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	require.Less(t, members[0].Score, float64(time.Now().UnixNano()/int64(time.Millisecond)))
+}
+
+func TestWithCartLimitsRejectsUpdatesBeyondTheGivenLimits(t *testing.T) {
+	client := MustRedisTestClient()
+	limits := DefaultCartLimits()
+	limits.MaxItems = 1
+	updater := MustRedisCartUpdater(client, WithCartLimits(limits))
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFunc()
+
+	err := updater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		cart.CartDetails["food"] = ItemDetails{"diner": 1}
+		cart.CartDetails["drink"] = ItemDetails{"diner": 1}
+		return cart
+	})
+
+	require.True(t, errors.Is(err, ErrValidation))
+}
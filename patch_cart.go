@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// patches of the cart as encoded in JSON, as opposed to
+// the updates merged by compareAndUpdateCart
+const (
+	// RFC 7396, in which null removes
+	MergePatchMediaType = "application/merge-patch+json"
+	// RFC 6902, whose operations are applied all or none
+	JSONPatchMediaType = "application/json-patch+json"
+)
+
+func requestMediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// PatchCartWithContext applies the patch in the body, in whichever format
+// its content type is, to the cart and responds with the patched cart
+func PatchCartWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err.Error())
+		writeProblem(w, http.StatusBadRequest, badRequestProblem, "the body cannot be read", nil)
+		return
+	}
+
+	var patch func([]byte) ([]byte, error)
+	switch requestMediaType(r) {
+	case MergePatchMediaType:
+		// merge patches other than objects would replace the cart as a whole
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(body, &object); err != nil {
+			writeDecodingProblem(w, err)
+			return
+		}
+		patch = func(document []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(document, body)
+		}
+	case JSONPatchMediaType:
+		operations, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			writeDecodingProblem(w, err)
+			return
+		}
+		patch = operations.Apply
+	default:
+		writeProblem(w, http.StatusUnsupportedMediaType, unsupportedMediaProblem, fmt.Sprintf("patches must be either %s or %s", MergePatchMediaType, JSONPatchMediaType), nil)
+		return
+	}
+
+	finalCart, ok := updateCartOrAbort(ctx, cartUpdater, w, r, cartID, func(currentCart *Cart) (*Cart, error) {
+		return patchCart(currentCart, patch)
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, finalCart)
+}
+
+// applies the patch to the cart as encoded in JSON, removing diners left
+// with a quantity of zero and items left without diners as other updates do
+func patchCart(currentCart *Cart, patch func([]byte) ([]byte, error)) (*Cart, error) {
+	document, err := json.Marshal(currentCart)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling cart to patch: %w", err)
+	}
+
+	patched, err := patch(document)
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		return nil, fmt.Errorf("%w: %v", ErrPatchTestFailed, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	patchedCart := NewCart(currentCart.CartID)
+	if err := json.Unmarshal(patched, &patchedCart); err != nil {
+		return nil, fmt.Errorf("%w: patched cart cannot be decoded: %v", ErrInvalidPatch, err)
+	}
+	if patchedCart.CartID != currentCart.CartID {
+		return nil, fmt.Errorf("%w: cart_id must not be changed", ErrInvalidPatch)
+	}
+
+	currentCart.CartDetails = make(map[ItemID]ItemDetails)
+	for itemID, itemDetails := range patchedCart.CartDetails {
+		for dinerID, quantity := range itemDetails {
+			if quantity == 0 {
+				continue
+			}
+			if _, ok := currentCart.CartDetails[itemID]; !ok {
+				currentCart.CartDetails[itemID] = make(ItemDetails)
+			}
+			currentCart.CartDetails[itemID][dinerID] = quantity
+		}
+	}
+
+	return currentCart, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func servePatch(router http.Handler, mediaType string, cartID string, patch string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("PATCH", "/carts/"+cartID, bytes.NewBufferString(patch))
+	request.Header.Set("Content-Type", mediaType)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestRouterAppliesMergePatches(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1, "diner2": 1}, "drink": {"diner1": 1}, "dessert": {"diner1": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	response = servePatch(router, MergePatchMediaType+"; charset=utf-8", cartID, `{"cart_details": {"food": {"diner1": null, "diner2": 3}, "drink": null, "dessert": {"diner1": 0}, "side": {"diner3": 2}}}`)
+
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"2"`, response.Header().Get("ETag"))
+	var cart Cart
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner2": 3}, "side": {"diner3": 2}}, cart.CartDetails)
+}
+
+func TestRouterAppliesJSONPatches(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1}, "drink": {"diner1": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	response = servePatch(router, JSONPatchMediaType, cartID, `[
+		{"op": "test", "path": "/cart_details/food/diner1", "value": 1},
+		{"op": "replace", "path": "/cart_details/food/diner1", "value": 2},
+		{"op": "add", "path": "/cart_details/food/diner2", "value": 1},
+		{"op": "remove", "path": "/cart_details/drink"},
+		{"op": "add", "path": "/cart_details/dessert", "value": {"diner1": 1}}
+	]`)
+
+	require.Equal(t, http.StatusOK, response.Code)
+	var cart Cart
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 2, "diner2": 1}, "dessert": {"diner1": 1}}, cart.CartDetails)
+}
+
+func TestRouterAppliesNoneOfJSONPatchesFailingTests(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	response = servePatch(router, JSONPatchMediaType, cartID, `[
+		{"op": "replace", "path": "/cart_details/food/diner1", "value": 3},
+		{"op": "test", "path": "/cart_details/food/diner1", "value": 2}
+	]`)
+
+	require.Equal(t, http.StatusConflict, response.Code)
+	require.Equal(t, patchTestFailedProblem, mustDecodeProblem(t, response).Code)
+	var cart Cart
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1}}, cart.CartDetails)
+}
+
+func TestRouterRejectsPatchesThatCannotBeApplied(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	for _, testCase := range []struct {
+		name      string
+		mediaType string
+		patch     string
+		status    int
+		code      string
+	}{
+		{"undecodable merge patch", MergePatchMediaType, `[1]`, http.StatusUnprocessableEntity, validationProblem},
+		{"undecodable JSON patch", JSONPatchMediaType, `{"op": "add"}`, http.StatusUnprocessableEntity, validationProblem},
+		{"removal of a missing path", JSONPatchMediaType, `[{"op": "remove", "path": "/cart_details/drink"}]`, http.StatusUnprocessableEntity, invalidPatchProblem},
+		{"quantity of the wrong type", MergePatchMediaType, `{"cart_details": {"food": {"diner1": "two"}}}`, http.StatusUnprocessableEntity, invalidPatchProblem},
+		{"change of cart_id", JSONPatchMediaType, `[{"op": "replace", "path": "/cart_id", "value": "other"}]`, http.StatusUnprocessableEntity, invalidPatchProblem},
+		{"quantity beyond limits", MergePatchMediaType, `{"cart_details": {"food": {"diner1": 1000}}}`, http.StatusUnprocessableEntity, validationProblem},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			response := servePatch(router, testCase.mediaType, cartID, testCase.patch)
+
+			require.Equal(t, testCase.status, response.Code)
+			require.Equal(t, testCase.code, mustDecodeProblem(t, response).Code)
+		})
+	}
+
+	var cart Cart
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1}}, cart.CartDetails)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// the query params of reads that wait for the cart to change
+const (
+	// the version the cart must have moved past to be read
+	waitForVersionParam = "wait_for_version_gt"
+	// how long to wait for it, as a duration such as "10s"
+	waitParam = "wait"
+)
+
+// the version a read waits for the cart to move past, given either by the
+// wait_for_version_gt param or by the single ETag in If-None-Match along with
+// the wait param, and how long to wait for it, up to maxWait or not at all if
+// zero, responding with a problem if the request asks to wait but not for what
+// or how long
+func pollVersion(w http.ResponseWriter, r *http.Request, maxWait time.Duration) (int64, time.Duration, bool) {
+	query := r.URL.Query()
+	wait := maxWait
+	if value := query.Get(waitParam); value != "" {
+		requested, err := time.ParseDuration(value)
+		if err != nil || requested <= 0 {
+			writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("%s must be a positive duration such as \"10s\"", waitParam), nil)
+			return 0, 0, false
+		}
+		if requested < wait {
+			wait = requested
+		}
+	}
+
+	if value := query.Get(waitForVersionParam); value != "" {
+		version, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || version < 0 {
+			writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("%s must be a version of the cart", waitForVersionParam), nil)
+			return 0, 0, false
+		}
+		return version, wait, true
+	}
+	if query.Get(waitParam) == "" {
+		return 0, 0, true
+	}
+
+	// the ETag the client already has, compared weakly as is usual for reads
+	etags := splitETags(r.Header.Get("If-None-Match"))
+	if len(etags) != 1 {
+		writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("%s requires %s or If-None-Match with a single ETag of the cart", waitParam, waitForVersionParam), nil)
+		return 0, 0, false
+	}
+	version, ok := parseCartETag(strings.TrimPrefix(etags[0], "W/"))
+	if !ok {
+		writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("%s requires %s or If-None-Match with a single ETag of the cart", waitParam, waitForVersionParam), nil)
+		return 0, 0, false
+	}
+
+	return version, wait, true
+}
+
+// lets reads of the cart wait for it to move past a version before being
+// served by next as usual, responding with 304 and the ETag of the cart as it
+// is if it did not in time or stop was closed in the meantime
+func pollCart(maxWait time.Duration, readTimeout time.Duration, cartReader CartReader, stop <-chan struct{}, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, wait, ok := pollVersion(w, r, maxWait)
+		if !ok {
+			return
+		}
+		if wait == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cartWatcher, ok := cartReader.(CartWatcher)
+		if !ok {
+			writeProblem(w, http.StatusNotImplemented, notImplementedProblem, "carts cannot be waited for", nil)
+			return
+		}
+
+		cartID := mux.Vars(r)["cartID"]
+		ctx, cancelFunc := context.WithCancel(r.Context())
+		defer cancelFunc()
+
+		events, currentCart, ok := watchThenReadCart(ctx, cartWatcher, cartReader, readTimeout, w, cartID)
+		if !ok {
+			return
+		}
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for currentCart.Version <= version {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				writeUnchanged(w, currentCart.Version)
+				return
+			case <-stop:
+				writeUnchanged(w, currentCart.Version)
+				return
+			case event, ok := <-events:
+				if !ok {
+					writeUnchanged(w, currentCart.Version)
+					return
+				}
+				// events may arrive out of order
+				if event.Version > currentCart.Version {
+					currentCart.Version = event.Version
+				}
+			}
+		}
+		// stops watching before reading
+		cancelFunc()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeUnchanged(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", cartETag(version))
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func pollRouter(router http.Handler, url string, ifNoneMatch string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", url, nil)
+	if ifNoneMatch != "" {
+		request.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	return response
+}
+
+// patches the cart once polls had the time to start waiting
+func patchCartLater(router http.Handler, cartID string, requestBody string) {
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		request := httptest.NewRequest("PATCH", "/carts/"+cartID, bytes.NewBufferString(requestBody))
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}()
+}
+
+func TestRouterReadsCartsPastVersionWithoutWaiting(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+
+	start := time.Now()
+	response := pollRouter(router, "/carts/"+cartID+"?wait_for_version_gt=0", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestRouterWaitsForCartsToMovePastVersion(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+
+	for version, path := range []string{"", "/items/food", "/items/food/diners/diner", "/diners/diner"} {
+		patchCartLater(router, cartID, `{"cart_details": {"food": {"diner": 2}}}`)
+		response := pollRouter(router, "/carts/"+cartID+path+"?wait_for_version_gt="+strconv.Itoa(version+1), "")
+		require.Equal(t, http.StatusOK, response.Code, path)
+		require.Equal(t, cartETag(int64(version+2)), response.Header().Get("ETag"), path)
+	}
+
+	patchCartLater(router, cartID, `{"cart_details": {"food": {"diner": 3}}}`)
+	response := pollRouter(router, "/carts/"+cartID+"?wait_for_version_gt=5", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"6"`, response.Header().Get("ETag"))
+	var cart Cart
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&cart))
+	require.Equal(t, 3, cart.CartDetails["food"]["diner"])
+}
+
+func TestRouterRespondsNotModifiedToPollsOnceWaitElapses(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+
+	start := time.Now()
+	response := pollRouter(router, "/carts/"+cartID+"?wait_for_version_gt=1&wait=50ms", "")
+	require.Equal(t, http.StatusNotModified, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+	require.Empty(t, response.Body.String())
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// versions yet to be reached are waited for all the same
+	response = pollRouter(router, "/carts/"+cartID+"?wait_for_version_gt=10&wait=50ms", "")
+	require.Equal(t, http.StatusNotModified, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+}
+
+func TestRouterWaitsForCartsToChangeFromIfNoneMatch(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+
+	response := pollRouter(router, "/carts/"+cartID+"?wait=50ms", `W/"1"`)
+	require.Equal(t, http.StatusNotModified, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+
+	patchCartLater(router, cartID, `{"cart_details": {"food": {"diner": 2}}}`)
+	response = pollRouter(router, "/carts/"+cartID+"?wait=5s", `"1"`)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"2"`, response.Header().Get("ETag"))
+
+	// without wait, If-None-Match is only compared with the cart as it is
+	response = pollRouter(router, "/carts/"+cartID, `"2"`)
+	require.Equal(t, http.StatusNotModified, response.Code)
+}
+
+func TestRouterCapsPollsAtMaxPollWait(t *testing.T) {
+	client := MustRedisTestClient()
+	config := DefaultConfig().HTTP
+	config.MaxPollWait = Duration(50 * time.Millisecond)
+	router := newRouter(config, DefaultCartLimits(), MustRedisCartUpdater(client), MustRedisCartReader(client), nil)
+	cartID := uuid.NewV4().String()
+
+	start := time.Now()
+	response := pollRouter(router, "/carts/"+cartID+"?wait_for_version_gt=0&wait=1h", "")
+	require.Equal(t, http.StatusNotModified, response.Code)
+	require.Equal(t, `"0"`, response.Header().Get("ETag"))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestRouterRejectsInvalidPolls(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	for _, test := range []struct {
+		query       string
+		ifNoneMatch string
+	}{
+		{"?wait_for_version_gt=-1", ""},
+		{"?wait_for_version_gt=latest", ""},
+		{"?wait_for_version_gt=1&wait=soon", ""},
+		{"?wait_for_version_gt=1&wait=-1s", ""},
+		{"?wait=1s", ""},
+		{"?wait=1s", `"1", "2"`},
+		{"?wait=1s", `"other"`},
+	} {
+		response := pollRouter(router, "/carts/"+cartID+test.query, test.ifNoneMatch)
+		require.Equal(t, http.StatusBadRequest, response.Code, test.query)
+		require.Equal(t, "application/problem+json", response.Header().Get("Content-Type"), test.query)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// stable codes of problems that clients can switch on,
+// unlike titles and details which are meant for humans
+const (
+	badRequestProblem       = "bad_request"
+	notFoundProblem         = "not_found"
+	methodNotAllowedProblem = "method_not_allowed"
+	unsupportedMediaProblem = "unsupported_media_type"
+	tooLargeProblem         = "request_too_large"
+	notImplementedProblem   = "not_implemented"
+	validationProblem       = "validation_failed"
+	conflictProblem         = "update_conflict"
+	versionMismatchProblem  = "version_mismatch"
+	invalidPatchProblem     = "invalid_patch"
+	patchTestFailedProblem  = "patch_test_failed"
+	lockTimeoutProblem      = "lock_timeout"
+	deadlineProblem         = "deadline_exceeded"
+	storeUnavailableProblem = "store_unavailable"
+	corruptCartProblem      = "corrupt_cart"
+	internalProblem         = "internal_error"
+)
+
+// Problem is an RFC 7807 problem details response, extended
+// with a stable code and the invalid fields of the request if any
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func newProblem(status int, code string, detail string, fields []FieldError) Problem {
+	return Problem{
+		Type:   "urn:redisync:problem:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+		Errors: fields,
+	}
+}
+
+func writeProblem(w http.ResponseWriter, status int, code string, detail string, fields []FieldError) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(newProblem(status, code, detail, fields)); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// responds with the problem that err amounts to
+func writeErrorProblem(ctx context.Context, w http.ResponseWriter, err error) {
+	problem := errorProblem(ctx, err)
+	writeProblem(w, problem.Status, problem.Code, problem.Detail, problem.Errors)
+}
+
+// the problem that err amounts to, the details of errors
+// that are not down to the request being left out of it
+func errorProblem(ctx context.Context, err error) Problem {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return newProblem(http.StatusUnprocessableEntity, validationProblem, "the cart is invalid", validationErr.Fields)
+	case errors.Is(err, ErrVersionMismatch):
+		return newProblem(http.StatusPreconditionFailed, versionMismatchProblem, "the cart has changed since the version in If-Match", nil)
+	case errors.Is(err, ErrInvalidPatch):
+		return newProblem(http.StatusUnprocessableEntity, invalidPatchProblem, "the patch cannot be applied to the cart", []FieldError{{Message: err.Error()}})
+	case errors.Is(err, ErrPatchTestFailed):
+		return newProblem(http.StatusConflict, patchTestFailedProblem, "the cart does not pass the tests of the patch", []FieldError{{Message: err.Error()}})
+	case errors.Is(err, ErrRevisionNotFound):
+		return newProblem(http.StatusNotFound, notFoundProblem, "the cart has no such revision in its history", nil)
+	case errors.Is(err, ErrLockTimeout):
+		return newProblem(http.StatusGatewayTimeout, lockTimeoutProblem, "timed out waiting for other updates of the cart", nil)
+	case deadlineExceeded(ctx, err):
+		return newProblem(http.StatusGatewayTimeout, deadlineProblem, "deadline exceeded before the cart could be served", nil)
+	case errors.Is(err, ErrLockLost), errors.Is(err, ErrStaleFencingToken), errors.Is(err, ErrTooManyConflicts):
+		return newProblem(http.StatusConflict, conflictProblem, "the cart was updated concurrently, retry the update", nil)
+	case errors.Is(err, ErrStoreUnavailable):
+		return newProblem(http.StatusServiceUnavailable, storeUnavailableProblem, "carts are temporarily unavailable", nil)
+	case errors.Is(err, ErrCorruptCart):
+		return newProblem(http.StatusInternalServerError, corruptCartProblem, "the stored cart cannot be decoded", nil)
+	default:
+		return newProblem(http.StatusInternalServerError, internalProblem, "", nil)
+	}
+}
+
+// responds to a body that could not be decoded, with the field at fault if known
+func writeDecodingProblem(w http.ResponseWriter, err error) {
+	field := FieldError{Message: err.Error()}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		field = FieldError{Field: typeErr.Field, Message: "must be of type " + typeErr.Type.String()}
+	}
+
+	writeProblem(w, http.StatusUnprocessableEntity, validationProblem, "the body cannot be decoded", []FieldError{field})
+}
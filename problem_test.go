@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustDecodeProblem(t *testing.T, response *httptest.ResponseRecorder) Problem {
+	require.Equal(t, "application/problem+json", response.Header().Get("Content-Type"))
+	var problem Problem
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+	require.Equal(t, response.Code, problem.Status)
+	require.Equal(t, http.StatusText(response.Code), problem.Title)
+	require.Equal(t, "urn:redisync:problem:"+problem.Code, problem.Type)
+
+	return problem
+}
+
+func TestWriteErrorProblemMapsErrorsToProblems(t *testing.T) {
+	expiredCtx, cancelFunc := context.WithTimeout(context.Background(), 0*time.Second)
+	defer cancelFunc()
+
+	for _, testCase := range []struct {
+		ctx    context.Context
+		err    error
+		status int
+		code   string
+	}{
+		{context.Background(), &ValidationError{Fields: []FieldError{{Field: "cart_id", Message: "must not be empty"}}}, http.StatusUnprocessableEntity, validationProblem},
+		{context.Background(), fmt.Errorf("error saving cart in redis: %w", ErrLockLost), http.StatusConflict, conflictProblem},
+		{context.Background(), fmt.Errorf("error saving cart in redis: %w", ErrStaleFencingToken), http.StatusConflict, conflictProblem},
+		{context.Background(), fmt.Errorf("error saving cart in redis: %w", ErrTooManyConflicts), http.StatusConflict, conflictProblem},
+		{context.Background(), fmt.Errorf("error updating cart at version 2: %w", ErrVersionMismatch), http.StatusPreconditionFailed, versionMismatchProblem},
+		{context.Background(), fmt.Errorf("%w: missing value", ErrInvalidPatch), http.StatusUnprocessableEntity, invalidPatchProblem},
+		{context.Background(), fmt.Errorf("%w: testing value failed", ErrPatchTestFailed), http.StatusConflict, patchTestFailedProblem},
+		{context.Background(), fmt.Errorf("timed out waiting for lock for update: %w", lockTimeout(errors.New("redis: nil"))), http.StatusGatewayTimeout, lockTimeoutProblem},
+		{expiredCtx, fmt.Errorf("timed out waiting for lock for update: %w", lockTimeout(expiredCtx.Err())), http.StatusGatewayTimeout, lockTimeoutProblem},
+		{expiredCtx, fmt.Errorf("error getting cart from redis: %w", expiredCtx.Err()), http.StatusGatewayTimeout, deadlineProblem},
+		{context.Background(), fmt.Errorf("error getting cart from redis: %w", &domainError{kind: ErrStoreUnavailable, err: errors.New("EOF")}), http.StatusServiceUnavailable, storeUnavailableProblem},
+		{context.Background(), fmt.Errorf("error unmarshaling cart from redis: %w", ErrCorruptCart), http.StatusInternalServerError, corruptCartProblem},
+		{context.Background(), errors.New("some error"), http.StatusInternalServerError, internalProblem},
+	} {
+		response := httptest.NewRecorder()
+		writeErrorProblem(testCase.ctx, response, testCase.err)
+
+		require.Equal(t, testCase.status, response.Code, testCase.err.Error())
+		problem := mustDecodeProblem(t, response)
+		require.Equal(t, testCase.code, problem.Code, testCase.err.Error())
+		// internal errors are not leaked to clients
+		require.NotContains(t, problem.Detail, "redis")
+	}
+}
+
+func TestWriteErrorProblemIncludesInvalidFields(t *testing.T) {
+	fields := []FieldError{
+		{Field: "cart_id", Message: "must not be empty"},
+		{Field: "cart_details.food.diner", Message: "must not be negative"},
+	}
+	response := httptest.NewRecorder()
+
+	writeErrorProblem(context.Background(), response, fmt.Errorf("error updating cart: %w", &ValidationError{Fields: fields}))
+
+	require.Equal(t, fields, mustDecodeProblem(t, response).Errors)
+}
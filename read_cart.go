@@ -5,28 +5,122 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+
+	"github.com/gorilla/mux"
 )
 
-// TODO: log and report errors to monitoring tools appropriately
-func ReadCartWithContext(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) {
-	// TODO: use path variables instead of request params
+// the cart ID is a path variable, or a request param on the deprecated routes
+func cartIDFromRequest(r *http.Request) (string, bool) {
+	if cartID, ok := mux.Vars(r)["cartID"]; ok {
+		return cartID, cartID != ""
+	}
+
 	cartID, ok := r.URL.Query()["cart_id"]
 	if !ok || len(cartID[0]) < 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return "", false
 	}
 
-	currentCart, err := cartReader.ReadCartWithContext(ctx, cartID[0])
-	if err != nil {
+	return cartID[0], true
+}
+
+func writeMissingCartIDProblem(w http.ResponseWriter) {
+	writeProblem(w, http.StatusBadRequest, badRequestProblem, "cart ID missing", nil)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
 		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// TODO: log and report errors to monitoring tools appropriately
+func ReadCartWithContext(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) {
+	currentCart, ok := readCart(ctx, cartReader, w, r)
+	if !ok {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(currentCart); err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	writeJSON(w, http.StatusOK, currentCart)
+}
+
+// ReadItemWithContext responds with the quantities of an item by diner
+func ReadItemWithContext(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) {
+	currentCart, ok := readCart(ctx, cartReader, w, r)
+	if !ok {
+		return
+	}
+
+	itemDetails, ok := currentCart.CartDetails[ItemID(mux.Vars(r)["itemID"])]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, notFoundProblem, "item not in cart", nil)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, itemDetails)
+}
+
+// ReadItemDinerWithContext responds with the quantity of an item for a diner
+func ReadItemDinerWithContext(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) {
+	currentCart, ok := readCart(ctx, cartReader, w, r)
+	if !ok {
 		return
 	}
+
+	quantity, ok := currentCart.CartDetails[ItemID(mux.Vars(r)["itemID"])][DinerID(mux.Vars(r)["dinerID"])]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, notFoundProblem, "diner has no quantity of item in cart", nil)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, quantityBody{Quantity: quantity})
+}
+
+// ReadDinerWithContext responds with the quantities of every item for a diner
+func ReadDinerWithContext(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) {
+	currentCart, ok := readCart(ctx, cartReader, w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dinerItems(currentCart, DinerID(mux.Vars(r)["dinerID"])))
+}
+
+// the body of requests and responses about a single quantity
+type quantityBody struct {
+	Quantity int `json:"quantity"`
+}
+
+// the items of the cart that the diner has a quantity of
+func dinerItems(cart Cart, dinerID DinerID) map[ItemID]int {
+	items := make(map[ItemID]int)
+	for itemID, itemDetails := range cart.CartDetails {
+		if quantity, ok := itemDetails[dinerID]; ok {
+			items[itemID] = quantity
+		}
+	}
+
+	return items
+}
+
+// reads the cart of the request, as of the at param if given,
+// responding with the error if any
+func readCart(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) (Cart, bool) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return Cart{}, false
+	}
+
+	currentCart, ok := readCartAt(ctx, cartReader, w, r, cartID)
+	if !ok {
+		return Cart{}, false
+	}
+	if notModified(w, r, &currentCart) {
+		return Cart{}, false
+	}
+
+	w.Header().Set("ETag", cartETag(currentCart.Version))
+	return currentCart, true
 }
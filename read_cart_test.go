@@ -54,12 +54,13 @@ func TestReadCartWithContextReturnsErrorIfErrorReadingCart(t *testing.T) {
 	require.Equal(t, http.StatusInternalServerError, response.Code)
 }
 
-func TestReadCartWithContextReturnsErrorIfContextTimesOut(t *testing.T) {
+func TestReadCartWithContextReturnsGatewayTimeoutIfContextTimesOut(t *testing.T) {
 	id := uuid.NewV4().String()
 	request, err := http.NewRequest("GET", fmt.Sprintf("/read_cart?cart_id=%s", id), nil)
 	require.NoError(t, err)
 
-	ctx, _ := context.WithTimeout(context.Background(), 0*time.Second)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 0*time.Second)
+	defer cancelFunc()
 	response := httptest.NewRecorder()
 	ReadCartWithContext(
 		ctx,
@@ -72,7 +73,8 @@ func TestReadCartWithContextReturnsErrorIfContextTimesOut(t *testing.T) {
 		request,
 	)
 
-	require.Equal(t, http.StatusInternalServerError, response.Code)
+	require.Equal(t, http.StatusGatewayTimeout, response.Code)
+	require.Equal(t, deadlineProblem, mustDecodeProblem(t, response).Code)
 }
 
 func TestReadCartWithContextReturnsCart(t *testing.T) {
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// ReadReplicaWithContext responds with the registers of the cart,
+// for another replica to merge into its own
+func ReadReplicaWithContext(ctx context.Context, cartReader CartReader, w http.ResponseWriter, r *http.Request) {
+	currentCart, ok := readCart(ctx, cartReader, w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, currentCart.Replicated())
+}
+
+// MergeReplicaWithContext merges the registers of another replica of the
+// cart into it, responding with the registers of the merged cart, which
+// replicas that merge each other's registers in any order converge to
+func MergeReplicaWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+
+	var remote ReplicatedCart
+	if err := json.NewDecoder(r.Body).Decode(&remote); err != nil {
+		log.Println(err.Error())
+		writeDecodingProblem(w, err)
+		return
+	}
+	if remote.CartID != "" && remote.CartID != cartID {
+		writeProblem(w, http.StatusBadRequest, badRequestProblem, "cart_id in body does not match the cart in the path", nil)
+		return
+	}
+	remote.CartID = cartID
+
+	finalCart, ok := updateCart(ctx, cartUpdater, w, r, cartID, func(currentCart *Cart) *Cart {
+		return mergeReplicatedCart(currentCart, remote)
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, finalCart.Replicated())
+}
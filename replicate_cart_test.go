@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// a region with its own carts, as if served from its own redis
+func mustRegionRouter(replicaID string) http.Handler {
+	client := MustRedisTestClient()
+	options := []RedisCartOption{WithKeyPrefix(uuid.NewV4().String() + ":"), WithReplicaID(replicaID)}
+
+	return newRouter(DefaultConfig().HTTP, DefaultCartLimits(), MustRedisCartUpdater(client, options...), MustRedisCartReader(client, options...), nil)
+}
+
+func mustExchangeReplicas(t *testing.T, from http.Handler, to http.Handler, cartID string) ReplicatedCart {
+	var replica ReplicatedCart
+	response := serveRouter(t, from, "GET", "/carts/"+cartID+"/replica", "", &replica)
+	require.Equal(t, http.StatusOK, response.Code)
+	serializedData, err := json.Marshal(replica)
+	require.NoError(t, err)
+
+	var merged ReplicatedCart
+	response = serveRouter(t, to, "POST", "/carts/"+cartID+"/merge", string(serializedData), &merged)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	return merged
+}
+
+func TestRouterConvergesRegionsMergingEachOthersReplicas(t *testing.T) {
+	us, eu := mustRegionRouter("us"), mustRegionRouter("eu")
+	cartID := uuid.NewV4().String()
+
+	response := serveRouter(t, us, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1}, "drink": {"diner1": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+	mustExchangeReplicas(t, us, eu, cartID)
+
+	// while partitioned, both regions update the cart
+	response = serveRouter(t, us, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner2": 2}, "drink": {}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+	response = serveRouter(t, eu, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 3}, "dessert": {"diner3": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	euMerged := mustExchangeReplicas(t, us, eu, cartID)
+	usMerged := mustExchangeReplicas(t, eu, us, cartID)
+
+	require.Equal(t, usMerged, euMerged)
+	expected := map[ItemID]ItemDetails{"food": {"diner1": 3, "diner2": 2}, "dessert": {"diner3": 1}}
+	for _, region := range []http.Handler{us, eu} {
+		var cart Cart
+		response := serveRouter(t, region, "GET", "/carts/"+cartID, "", &cart)
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, expected, cart.CartDetails)
+	}
+
+	// merging again changes nothing
+	require.Equal(t, usMerged, mustExchangeReplicas(t, eu, us, cartID))
+}
+
+func TestRouterRejectsReplicaOfAnotherCart(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	response := serveRouter(t, router, "POST", "/carts/"+cartID+"/merge", fmt.Sprintf(`{"cart_id": "%s", "registers": {}}`, uuid.NewV4().String()), nil)
+
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	require.Equal(t, badRequestProblem, mustDecodeProblem(t, response).Code)
+}
+
+func TestRouterRejectsReplicasThatWouldExceedLimits(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	response := serveRouter(t, router, "POST", "/carts/"+cartID+"/merge", `{"registers": {"food": {"diner": {"quantity": 1000, "timestamp": {"wall_time": 1, "logical": 0, "replica": "eu"}}}}}`, nil)
+
+	require.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	require.Equal(t, validationProblem, mustDecodeProblem(t, response).Code)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// same merge as compareAndUpdateCart, which for carts stored as hashes
+// amounts to deleting the fields of every item removed by the updates,
+// given as field prefixes, then setting the field of every (ItemID, DinerID)
+// in the updates or deleting it if zero, with items left without fields
+// disappearing by themselves, but run by redis itself so that it is atomic
+// with every other merge
+//
+// the merge is worked out before anything is written so that a merged cart
+// over the limits of items, diners or bytes, as Cart.Validate counts them, is
+// left as it was, replying with -1 and the fields it would have had
+//
+// every field that actually changed is stamped with a clock following the
+// latest of the cart, and the version of the cart incremented, the same
+// way as queueCartWrite, the changes being recorded in the history of the
+// cart given as the fourth key as well as logged if given the change log
+// as a fifth, replying with the version and the merged fields
+var mergeCartScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1])["ok"] == "string" then
+	return redis.error_reply("LEGACY cart is stored as a JSON blob")
+end
+local current, merged = {}, {}
+local fields = redis.call("HGETALL", KEYS[1])
+for index = 1, #fields, 2 do
+	if string.sub(fields[index], 1, 1) == "[" then
+		current[fields[index]], merged[fields[index]] = fields[index + 1], fields[index + 1]
+	end
+end
+local removedItems = tonumber(ARGV[14])
+for field in pairs(current) do
+	for index = 15, 14 + removedItems do
+		if string.sub(field, 1, #ARGV[index]) == ARGV[index] then
+			merged[field] = nil
+			break
+		end
+	end
+end
+for index = 15 + removedItems, #ARGV, 2 do
+	if ARGV[index + 1] == "0" then
+		merged[ARGV[index]] = nil
+	else
+		merged[ARGV[index]] = ARGV[index + 1]
+	end
+end
+
+-- fields are JSON arrays of the item and diner IDs as go encodes them, so
+-- the cart encoded as JSON is as long as its parts without being encoded
+local function split(field)
+	local index = 3
+	while string.sub(field, index, index) ~= '"' do
+		index = index + (string.sub(field, index, index) == "\\" and 2 or 1)
+	end
+	return string.sub(field, 2, index), string.sub(field, index + 2, -2)
+end
+local items, diners, bytes = {}, {}, tonumber(ARGV[13])
+for field, quantity in pairs(merged) do
+	local item, diner = split(field)
+	if not items[item] then
+		items[item] = true
+		items[#items + 1] = item
+		-- "item":{}, with the comma before every item but the first
+		bytes = bytes + #item + 3 + (#items > 1 and 1 or 0)
+	else
+		-- the comma before every diner but the first
+		bytes = bytes + 1
+	end
+	diners[diner] = true
+	-- "diner":quantity
+	bytes = bytes + #diner + 1 + #quantity
+end
+local dinerCount = 0
+for _ in pairs(diners) do
+	dinerCount = dinerCount + 1
+end
+if #items > tonumber(ARGV[10]) or dinerCount > tonumber(ARGV[11]) or bytes > tonumber(ARGV[12]) then
+	local reply = {}
+	for field, quantity in pairs(merged) do
+		table.insert(reply, field)
+		table.insert(reply, quantity)
+	end
+	return {-1, reply}
+end
+
+local wallTime, logical = tonumber(ARGV[2]), 0
+local latest = redis.call("HGET", KEYS[2], "latest")
+if latest then
+	local latestWallTime, latestLogical = string.match(latest, "^(%d+):(%d+):")
+	if tonumber(latestWallTime) >= wallTime then
+		wallTime, logical = tonumber(latestWallTime), tonumber(latestLogical) + 1
+	end
+end
+local stamp = string.format("%d:%d:%s", wallTime, logical, ARGV[3])
+local changes = {}
+local function change(field, before, after)
+	local ids = cjson.decode(field)
+	table.insert(changes, {item_id = ids[1], diner_id = ids[2], before = tonumber(before) or 0, after = tonumber(after) or 0})
+	redis.call("HSET", KEYS[2], field, stamp)
+end
+for field, before in pairs(current) do
+	if not merged[field] then
+		redis.call("HDEL", KEYS[1], field)
+		change(field, before, 0)
+	end
+end
+for field, after in pairs(merged) do
+	if current[field] ~= after then
+		redis.call("HSET", KEYS[1], field, after)
+		change(field, current[field], after)
+	end
+end
+if #changes > 0 then
+	redis.call("HSET", KEYS[2], "latest", stamp)
+end
+local version = redis.call("INCR", KEYS[3])
+for index = 1, 3 do
+	redis.call("PEXPIRE", KEYS[index], ARGV[1])
+end
+-- an empty table would be encoded as an object
+local payload = "[]"
+if #changes > 0 then
+	table.sort(changes, function(a, b)
+		if a.item_id ~= b.item_id then
+			return a.item_id < b.item_id
+		end
+		return a.diner_id < b.diner_id
+	end)
+	payload = cjson.encode(changes)
+end
+local revision = {"*", "version", version, "timestamp", ARGV[2], "author", ARGV[7], "payload", ARGV[8], "changes", payload}
+if tonumber(ARGV[9]) > 0 then
+	redis.call("XADD", KEYS[4], "MAXLEN", ARGV[9], unpack(revision))
+else
+	redis.call("XADD", KEYS[4], unpack(revision))
+end
+redis.call("PEXPIRE", KEYS[4], ARGV[6])
+if KEYS[5] then
+	local args = {"*", "cart_id", ARGV[4], "version", version, "timestamp", ARGV[2], "changes", payload}
+	if tonumber(ARGV[5]) > 0 then
+		redis.call("XADD", KEYS[5], "MAXLEN", ARGV[5], unpack(args))
+	else
+		redis.call("XADD", KEYS[5], unpack(args))
+	end
+end
+return {version, redis.call("HGETALL", KEYS[1])}
+`)
+
+type CartMerger interface {
+	MergeCartWithContext(context.Context, string, Cart) (Cart, error)
+}
+
+// RedisScriptCartUpdater merges updates with RedisScriptCartMerger, see
+// ScriptUpdateStrategy, and makes every other update optimistically, which
+// it can since the script writes the same keys that optimistic updates watch
+type RedisScriptCartUpdater struct {
+	*RedisScriptCartMerger
+	*RedisOptimisticCartUpdater
+}
+
+func NewRedisScriptCartUpdater(client *redis.Client, options ...RedisCartOption) (*RedisScriptCartUpdater, error) {
+	merger, err := NewRedisScriptCartMerger(client, options...)
+	if err != nil {
+		return nil, err
+	}
+	updater, err := NewRedisOptimisticCartUpdater(client, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisScriptCartUpdater{
+		RedisScriptCartMerger:      merger,
+		RedisOptimisticCartUpdater: updater,
+	}, nil
+}
+
+// RedisScriptCartMerger merges updates into carts in a single round trip
+// with no locks, at the cost of only supporting the merge semantics of
+// compareAndUpdateCart rather than arbitrary updater functions
+type RedisScriptCartMerger struct {
+	client *redis.Client
+	config RedisCartConfig
+}
+
+func NewRedisScriptCartMerger(client *redis.Client, options ...RedisCartOption) (*RedisScriptCartMerger, error) {
+	config, err := newRedisCartConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisScriptCartMerger{
+		client: client,
+		config: config,
+	}, nil
+}
+
+// the updates are validated as they are, quantities included, and the
+// merged cart against the limits of items, diners and bytes by the script
+func (r *RedisScriptCartMerger) MergeCartWithContext(ctx context.Context, cartID string, updates Cart) (Cart, error) {
+	updates.CartID = cartID
+	if err := updates.Validate(r.config.Limits); err != nil {
+		return Cart{}, fmt.Errorf("error merging cart: %w", err)
+	}
+	// marshaling carts cannot fail
+	emptyCart, _ := json.Marshal(NewCart(cartID))
+
+	var removedItems []interface{}
+	for itemID, itemDetails := range updates.CartDetails {
+		if len(itemDetails) == 0 {
+			removedItems = append(removedItems, cartItemFieldPrefix(itemID))
+		}
+	}
+	audit := updateAuditFromContext(ctx)
+	args := []interface{}{
+		r.config.CartTTL.Milliseconds(),
+		hlcWallTime(r.config.Clock()),
+		r.config.ReplicaID,
+		cartID,
+		r.config.ChangeLogMaxLen,
+		r.config.historyTTL().Milliseconds(),
+		string(audit.Author),
+		string(audit.Payload),
+		r.config.HistoryMaxLen,
+		r.config.Limits.MaxItems,
+		r.config.Limits.MaxDiners,
+		r.config.Limits.MaxBytes,
+		len(emptyCart),
+		len(removedItems),
+	}
+	args = append(args, removedItems...)
+	for field, quantity := range cartFields(&updates) {
+		args = append(args, field, quantity)
+	}
+
+	for {
+		// Run uses EVALSHA and falls back to EVAL when redis has
+		// not cached the script yet, for example after a restart
+		cartKey := r.config.cartKey(cartID)
+		keys := []string{cartKey, cartClocks(cartKey), cartVersion(cartKey), cartHistory(cartKey)}
+		if r.config.ChangeLogKey != "" {
+			keys = append(keys, r.config.changeLogKey())
+		}
+		reply, err := mergeCartScript.Run(ctx, r.client, keys, args...).Result()
+		if err != nil && strings.HasPrefix(err.Error(), "LEGACY") {
+			if err := r.migrateLegacyCart(ctx, cartID); err != nil {
+				return Cart{}, err
+			}
+
+			continue
+		}
+		if err != nil {
+			return Cart{}, fmt.Errorf("error merging cart in redis: %w", unavailable(ctx, err))
+		}
+
+		// HGETALL replies with alternating fields and values
+		var version int64
+		var values []interface{}
+		if replies, _ := reply.([]interface{}); len(replies) == 2 {
+			version, _ = replies[0].(int64)
+			values, _ = replies[1].([]interface{})
+		}
+		fields := make(map[string]string, len(values)/2)
+		for index := 0; index+1 < len(values); index += 2 {
+			fields[fmt.Sprint(values[index])] = fmt.Sprint(values[index+1])
+		}
+
+		cart, err := cartFromFields(cartID, fields)
+		if err != nil {
+			return Cart{}, fmt.Errorf("error unmarshaling merged cart from redis: %w", err)
+		}
+		if version < 0 {
+			err := cart.Validate(r.config.Limits)
+			if err == nil {
+				// the script only rejects carts that Validate would
+				err = &ValidationError{Fields: []FieldError{{Field: "cart_details", Message: "must be within the limits of the cart"}}}
+			}
+			return Cart{}, fmt.Errorf("error merging cart: %w", err)
+		}
+		cart.Version = version
+		// watchers catch up on the next event or when they resume,
+		// so failing to publish does not fail a merge that was saved
+		_ = r.config.publishCart(ctx, r.client, cartID, &cart)
+
+		return cart, nil
+	}
+}
+
+// rewrites a legacy cart as a hash, which is left to go rather than the
+// script so that there is a single encoding of fields to keep in sync
+func (r *RedisScriptCartMerger) migrateLegacyCart(ctx context.Context, cartID string) error {
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		cart, legacy, err := r.config.loadCart(ctx, tx, cartID)
+		if errors.Is(err, ErrCorruptCart) {
+			return fmt.Errorf("error unmarshaling existing cart from redis: %w", err)
+		}
+		if err != nil {
+			return fmt.Errorf("error getting existing cart from redis: %w", unavailable(ctx, err))
+		}
+		if !legacy {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.config.queueCartWrite(ctx, pipe, cartID, snapshotCart(&cart), true, &cart)
+
+			return nil
+		})
+
+		return err
+	}, r.config.cartKey(cartID))
+
+	// someone else migrated the cart first, which is just as good
+	if err != nil && err != redis.TxFailedErr {
+		return fmt.Errorf("error migrating legacy cart: %w", unavailable(ctx, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisScriptMergeCartWithContextMergesLikeCompareAndUpdateCart(t *testing.T) {
+	client := MustRedisTestClient()
+	merger := MustRedisScriptCartMerger(client)
+
+	for _, legacy := range []bool{false, true} {
+		for _, testCase := range compareAndUpdateCartTestCases {
+			t.Run(fmt.Sprintf("%s with legacy %t", testCase.name, legacy), func(t *testing.T) {
+				cartID := uuid.NewV4().String()
+				ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancelFunc()
+				if testCase.current != nil {
+					mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: testCase.current}, legacy)
+				}
+
+				mergedCart, err := merger.MergeCartWithContext(ctx, cartID, Cart{CartID: cartID, CartDetails: copyCartDetails(testCase.updates)})
+
+				require.NoError(t, err)
+				require.Equal(t, cartID, mergedCart.CartID)
+				require.Equal(t, testCase.expected, mergedCart.CartDetails)
+				savedCart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+				require.NoError(t, err)
+				require.Equal(t, testCase.expected, savedCart.CartDetails)
+				kind, err := client.Type(ctx, cartID).Result()
+				require.NoError(t, err)
+				// carts left empty are deleted along with their last field
+				if len(testCase.expected) > 0 {
+					require.Equal(t, "hash", kind)
+				} else {
+					require.Equal(t, "none", kind)
+				}
+			})
+		}
+	}
+}
+
+func TestRedisScriptMergeCartWithContextReturnsErrorIfExistingCartIsInvalidJSON(t *testing.T) {
+	client := MustRedisTestClient()
+	merger := MustRedisScriptCartMerger(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.Set(ctx, cartID, "totally not JSON", 100*time.Millisecond).Result()
+	require.NoError(t, err)
+
+	_, err = merger.MergeCartWithContext(ctx, cartID, NewCart(cartID))
+
+	require.Error(t, err)
+	require.Regexp(t, "error unmarshaling existing cart", err.Error())
+}
+
+func TestRedisScriptMergeCartWithContextReturnsErrorIfErrorRetrievingExistingCartFromRedis(t *testing.T) {
+	client := MustRedisTestClient()
+	merger := MustRedisScriptCartMerger(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.LPush(ctx, cartID, "irrelevant").Result()
+	require.NoError(t, err)
+	defer func() {
+		client.Del(ctx, cartID).Result()
+	}()
+
+	_, err = merger.MergeCartWithContext(ctx, cartID, NewCart(cartID))
+
+	require.Error(t, err)
+	require.Regexp(t, "error merging cart", err.Error())
+}
+
+func TestRedisScriptMergeCartWithContextFallsBackToEvalIfScriptIsNotCached(t *testing.T) {
+	client := MustRedisTestClient()
+	merger := MustRedisScriptCartMerger(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	_, err := client.ScriptFlush(ctx).Result()
+	require.NoError(t, err)
+
+	cart, err := merger.MergeCartWithContext(ctx, cartID, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1}}})
+
+	require.NoError(t, err)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+}
+
+func TestRedisScriptMergeCartWithContextRejectsInvalidUpdates(t *testing.T) {
+	client := MustRedisTestClient()
+	merger := MustRedisScriptCartMerger(client)
+	cartID := uuid.NewV4().String()
+
+	_, err := merger.MergeCartWithContext(context.Background(), cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1000}}})
+
+	require.True(t, errors.Is(err, ErrValidation))
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Empty(t, cart.CartDetails)
+}
+
+func TestRedisScriptMergeCartWithContextRejectsMergedCartsOverLimits(t *testing.T) {
+	client := MustRedisTestClient()
+	limits := DefaultCartLimits()
+	limits.MaxItems = 2
+	merger := MustRedisScriptCartMerger(client, WithCartLimits(limits))
+	cartID := uuid.NewV4().String()
+
+	_, err := merger.MergeCartWithContext(context.Background(), cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1}, "drink": {"diner": 1}}})
+	require.NoError(t, err)
+	_, err = merger.MergeCartWithContext(context.Background(), cartID, Cart{CartDetails: map[ItemID]ItemDetails{"fries": {"diner": 1}}})
+
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr), "%v", err)
+	require.Equal(t, []FieldError{{Field: "cart_details", Message: "must have at most 2 items"}}, validationErr.Fields)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), cart.Version)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 1}, "drink": {"diner": 1}}, cart.CartDetails)
+
+	// replacing an item keeps the cart within the limits
+	_, err = merger.MergeCartWithContext(context.Background(), cartID, Cart{CartDetails: map[ItemID]ItemDetails{"drink": {}, "fries": {"diner": 1}}})
+	require.NoError(t, err)
+}
+
+func TestRedisScriptMergeCartWithContextCountsBytesAsValidateDoes(t *testing.T) {
+	client := MustRedisTestClient()
+	// IDs that go escapes when encoding them as JSON
+	cartDetails := map[ItemID]ItemDetails{
+		`<food & "drink">`: {"diner\\1": 12, "diner\n2": 3},
+		"fries\u2028":      {"dîner": 1},
+	}
+
+	for _, overBy := range []int{0, 1} {
+		cartID := uuid.NewV4().String()
+		encoded, err := json.Marshal(Cart{CartID: cartID, CartDetails: cartDetails})
+		require.NoError(t, err)
+		limits := DefaultCartLimits()
+		limits.MaxBytes = len(encoded) - overBy
+		merger := MustRedisScriptCartMerger(client, WithCartLimits(limits))
+
+		_, err = merger.MergeCartWithContext(context.Background(), cartID, Cart{CartDetails: map[ItemID]ItemDetails{"fries\u2028": {"dîner": 1}}})
+		require.NoError(t, err)
+		_, err = merger.MergeCartWithContext(context.Background(), cartID, Cart{CartDetails: copyCartDetails(cartDetails)})
+
+		if overBy == 0 {
+			require.NoError(t, err)
+		} else {
+			require.True(t, errors.Is(err, ErrValidation), "%v", err)
+		}
+	}
+}
+
+func TestRedisScriptMergeCartWithContextIncrementsVersion(t *testing.T) {
+	client := MustRedisTestClient()
+	merger := MustRedisScriptCartMerger(client)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	require.NoError(t, MustRedisCartUpdater(client).UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart { return cart }))
+
+	mergedCart, err := merger.MergeCartWithContext(ctx, cartID, Cart{CartDetails: map[ItemID]ItemDetails{"food": {"diner": 1}}})
+
+	require.NoError(t, err)
+	require.Equal(t, int64(2), mergedCart.Version)
+	savedCart, err := MustRedisCartReader(client).ReadCartWithContext(ctx, cartID)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), savedCart.Version)
+}
+
+func TestRouterMergesCartsWithScriptUpdateStrategy(t *testing.T) {
+	client := MustRedisTestClient()
+	updater, err := NewCartUpdater(client, ScriptUpdateStrategy)
+	require.NoError(t, err)
+	router := newRouter(DefaultConfig().HTTP, DefaultCartLimits(), updater, MustRedisCartReader(client), nil)
+	cartID := uuid.NewV4().String()
+
+	var cart Cart
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}, "drink": {"diner": 1}}}`, &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 1}, "drink": {"diner": 1}}, cart.CartDetails)
+
+	response = serveRouter(t, router, "DELETE", "/carts/"+cartID+"/items/drink", "", nil)
+	require.Equal(t, http.StatusNoContent, response.Code)
+	require.Equal(t, `"2"`, response.Header().Get("ETag"))
+
+	// updates that are not merges are made optimistically
+	var results operationsResponse
+	response = serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"operations": [{"op": "inc", "item_id": "food", "diner_id": "diner", "amount": 2}]}`, &results)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, 3, results.Cart.CartDetails["food"]["diner"])
+
+	// as are conditional ones
+	request := httptest.NewRequest("PUT", "/carts/"+cartID+"/items/food/diners/diner", bytes.NewBufferString(`{"quantity": 5}`))
+	request.Header.Set("If-Match", `"2"`)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+
+	savedCart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), savedCart.Version)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 3}}, savedCart.CartDetails)
+}
+
+// the script keeps a copy of the limits, clocks, history and change log of
+// the writes made in go, so the same updates must leave the same traces
+func TestRedisScriptMergeCartWithContextWritesAsUpdatersDo(t *testing.T) {
+	client := MustRedisTestClient()
+	now := time.Unix(1700000000, 0)
+	limits := CartLimits{MaxQuantity: 99, MaxItems: 3, MaxDiners: 3, MaxBytes: 200}
+	steps := []map[ItemID]ItemDetails{
+		{"food": {"diner1": 1, "diner2": 2}, "drink": {"diner1": 1}},
+		{"fries": {"diner3": 1}, "pie": {"diner1": 1}},
+		{"drink": {}, "fries": {"diner3": 1}},
+		{"food": {"diner4": 1}},
+		{ItemID(strings.Repeat("x", 150)): {"diner1": 1}},
+		{`<food & "drink">`: {"diner\\1": 12}, "food": {"diner1": 0}},
+		{"fries": {"diner3": 1}},
+	}
+
+	type traces struct {
+		errs      [][]FieldError
+		fields    map[string]string
+		clocks    map[string]string
+		revisions []CartRevision
+		changes   []CartChange
+	}
+	trace := func(write func(context.Context, []RedisCartOption, string, Cart) error) traces {
+		options := []RedisCartOption{
+			WithClock(func() time.Time { return now }),
+			WithReplicaID("replica"),
+			WithCartLimits(limits),
+			WithChangeLog(mustChangeLog(t), 0),
+		}
+		config, err := newRedisCartConfig(options)
+		require.NoError(t, err)
+		cartID := uuid.NewV4().String()
+
+		var traced traces
+		for index, cartDetails := range steps {
+			ctx := WithUpdateAudit(context.Background(), UpdateAudit{Author: "diner1", Payload: json.RawMessage(fmt.Sprintf(`{"step":%d}`, index))})
+			err := write(ctx, options, cartID, Cart{CartDetails: copyCartDetails(cartDetails)})
+			var validationErr *ValidationError
+			if err != nil {
+				require.True(t, errors.As(err, &validationErr), "%v", err)
+				traced.errs = append(traced.errs, validationErr.Fields)
+			} else {
+				traced.errs = append(traced.errs, nil)
+			}
+		}
+
+		traced.fields, err = client.HGetAll(context.Background(), cartID).Result()
+		require.NoError(t, err)
+		traced.clocks, err = client.HGetAll(context.Background(), cartClocks(cartID)).Result()
+		require.NoError(t, err)
+		messages, err := client.XRange(context.Background(), cartHistory(cartID), "-", "+").Result()
+		require.NoError(t, err)
+		for _, message := range messages {
+			revision, err := cartRevisionFromMessage(message)
+			require.NoError(t, err)
+			revision.ID = ""
+			traced.revisions = append(traced.revisions, revision)
+		}
+		messages, err = client.XRange(context.Background(), config.changeLogKey(), "-", "+").Result()
+		require.NoError(t, err)
+		for _, message := range messages {
+			change, err := cartChangeFromMessage(message)
+			require.NoError(t, err)
+			require.Equal(t, cartID, change.CartID)
+			change.ID, change.CartID = "", ""
+			traced.changes = append(traced.changes, change)
+		}
+
+		return traced
+	}
+
+	updated := trace(func(ctx context.Context, options []RedisCartOption, cartID string, updates Cart) error {
+		return MustRedisCartUpdater(client, options...).UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+			return compareAndUpdateCart(cart, updates)
+		})
+	})
+	merged := trace(func(ctx context.Context, options []RedisCartOption, cartID string, updates Cart) error {
+		_, err := MustRedisScriptCartMerger(client, options...).MergeCartWithContext(ctx, cartID, updates)
+		return err
+	})
+
+	// every kind of limit is rejected along the way
+	require.Equal(t, []bool{false, true, false, true, true, false, false}, func() []bool {
+		rejected := make([]bool, len(updated.errs))
+		for index := range updated.errs {
+			rejected[index] = updated.errs[index] != nil
+		}
+		return rejected
+	}())
+	require.Equal(t, updated, merged)
+}
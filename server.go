@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// implemented by cart updaters that hold locks across
+// round trips, which should not outlive the server
+type lockReleaser interface {
+	ReleaseLocks() error
+}
+
+// marks routes kept only for clients that have yet to move to their successors
+func deprecated(successor string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streams of events and collaborations never finish by themselves, so are
+// ended once stop is closed, those whose connections were hijacked being
+// waited for separately since the server no longer knows of them
+type streamGroup struct {
+	stop     chan struct{}
+	hijacked sync.WaitGroup
+}
+
+func newStreamGroup() *streamGroup {
+	return &streamGroup{stop: make(chan struct{})}
+}
+
+// waits for hijacked streams to end until ctx is done
+func (g *streamGroup) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.hijacked.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// streams of a nil group are never stopped
+func (g *streamGroup) stopped() <-chan struct{} {
+	if g == nil {
+		return nil
+	}
+
+	return g.stop
+}
+
+// tracks a stream about to be hijacked, which is done once the returned func is called
+func (g *streamGroup) hijack() func() {
+	if g == nil {
+		return func() {}
+	}
+
+	g.hijacked.Add(1)
+	return g.hijacked.Done
+}
+
+// streams end when stopped by the group, or only when their clients disconnect if nil
+func newRouter(config HTTPConfig, limits CartLimits, cartUpdater CartUpdater, cartReader CartReader, streams *streamGroup) http.Handler {
+	readTimeout := time.Duration(config.ReadTimeout)
+	updateTimeout := time.Duration(config.UpdateTimeout)
+	adminTimeout := time.Duration(config.AdminTimeout)
+	reading := func(handler func(context.Context, CartReader, http.ResponseWriter, *http.Request)) http.Handler {
+		return withTimeout(readTimeout, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(r.Context(), cartReader, w, r)
+		}))
+	}
+	updating := func(handler func(context.Context, CartUpdater, http.ResponseWriter, *http.Request)) http.Handler {
+		return withUpdateAudit(limits, withTimeout(updateTimeout, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(r.Context(), cartUpdater, w, r)
+		})))
+	}
+	// reads of the cart may first wait for it to change, for up to the max poll wait
+	polling := func(handler func(context.Context, CartReader, http.ResponseWriter, *http.Request)) http.Handler {
+		return pollCart(time.Duration(config.MaxPollWait), readTimeout, cartReader, streams.stopped(), reading(handler))
+	}
+	// replicas exchange whole carts, for which clients are not waiting
+	administering := func(handler http.HandlerFunc) http.Handler {
+		return withTimeout(adminTimeout, handler)
+	}
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, http.StatusNotFound, notFoundProblem, "", nil)
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, http.StatusMethodNotAllowed, methodNotAllowedProblem, "", nil)
+	})
+	carts := router.PathPrefix("/carts/{cartID}").Subrouter()
+	carts.Handle("", polling(ReadCartWithContext)).Methods(http.MethodGet)
+	carts.Handle("", updating(UpdateCartWithContext)).Methods(http.MethodPatch)
+	carts.Handle("", updating(ReplaceCartWithContext)).Methods(http.MethodPut)
+	carts.Handle("", updating(DeleteCartWithContext)).Methods(http.MethodDelete)
+	carts.Handle("/items/{itemID}", polling(ReadItemWithContext)).Methods(http.MethodGet)
+	carts.Handle("/items/{itemID}", updating(UpdateItemWithContext)).Methods(http.MethodPatch)
+	carts.Handle("/items/{itemID}", updating(ReplaceItemWithContext)).Methods(http.MethodPut)
+	carts.Handle("/items/{itemID}", updating(DeleteItemWithContext)).Methods(http.MethodDelete)
+	carts.Handle("/items/{itemID}/diners/{dinerID}", polling(ReadItemDinerWithContext)).Methods(http.MethodGet)
+	carts.Handle("/items/{itemID}/diners/{dinerID}", updating(ReplaceItemDinerWithContext)).Methods(http.MethodPut)
+	carts.Handle("/items/{itemID}/diners/{dinerID}", updating(DeleteItemDinerWithContext)).Methods(http.MethodDelete)
+	carts.Handle("/diners/{dinerID}", polling(ReadDinerWithContext)).Methods(http.MethodGet)
+	carts.Handle("/diners/{dinerID}", updating(DeleteDinerWithContext)).Methods(http.MethodDelete)
+	carts.Handle("/history", reading(ReadCartHistoryWithContext)).Methods(http.MethodGet)
+	carts.Handle("/events", watchCart(time.Duration(config.HeartbeatInterval), readTimeout, cartReader, streams.stopped())).Methods(http.MethodGet)
+	carts.Handle("/ws", collaborateOnCart(time.Duration(config.HeartbeatInterval), readTimeout, updateTimeout, cartUpdater, cartReader, streams)).Methods(http.MethodGet)
+	carts.Handle("/replica", administering(func(w http.ResponseWriter, r *http.Request) {
+		ReadReplicaWithContext(r.Context(), cartReader, w, r)
+	})).Methods(http.MethodGet)
+	carts.Handle("/merge", withUpdateAudit(limits, administering(func(w http.ResponseWriter, r *http.Request) {
+		MergeReplicaWithContext(r.Context(), cartUpdater, w, r)
+	}))).Methods(http.MethodPost)
+
+	router.Handle("/read_cart", deprecated("/carts/{cartID}", reading(ReadCartWithContext)))
+	router.Handle("/update_cart", deprecated("/carts/{cartID}", updating(UpdateCartWithContext)))
+
+	return router
+}
+
+// Serve serves carts on listener until ctx is cancelled, after which it
+// stops accepting requests and drains those in flight for up to the shutdown
+// timeout, then cancels any left and releases the cart locks they still hold
+func Serve(ctx context.Context, listener net.Listener, config HTTPConfig, limits CartLimits, cartUpdater CartUpdater, cartReader CartReader) error {
+	// requests are not cancelled along with ctx so that they can be drained
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	streams := newStreamGroup()
+	server := &http.Server{
+		Handler:     newRouter(config, limits, cartUpdater, cartReader, streams),
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
+	}
+	server.RegisterOnShutdown(func() { close(streams.stop) })
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("error serving http: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancelFunc := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancelFunc()
+
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr == nil {
+		shutdownErr = streams.wait(shutdownCtx)
+	}
+	if shutdownErr != nil {
+		cancelRequests()
+		server.Close()
+		// hijacked streams end along with their requests
+		streams.hijacked.Wait()
+		shutdownErr = fmt.Errorf("error draining in-flight requests: %w", shutdownErr)
+	}
+	<-serveErr
+
+	if releaser, ok := cartUpdater.(lockReleaser); ok {
+		if err := releaser.ReleaseLocks(); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	return shutdownErr
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// blocks every update mid-way, while holding the lock,
+// until unblocked so that it can be interrupted
+type blockingCartUpdater struct {
+	*RedisCartUpdater
+	updating chan struct{}
+	unblock  chan struct{}
+}
+
+func (b *blockingCartUpdater) UpdateCartWithContext(ctx context.Context, cartID string, updaterFunc func(*Cart) *Cart) error {
+	return b.RedisCartUpdater.UpdateCartWithContext(ctx, cartID, func(cart *Cart) *Cart {
+		close(b.updating)
+		<-b.unblock
+		return updaterFunc(cart)
+	})
+}
+
+func testHTTPConfig(shutdownTimeout time.Duration) HTTPConfig {
+	config := DefaultConfig().HTTP
+	config.ShutdownTimeout = Duration(shutdownTimeout)
+
+	return config
+}
+
+// starts serving in the background until the process is signalled
+func mustServe(t *testing.T, config HTTPConfig, cartUpdater CartUpdater) (string, context.Context, chan error) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	t.Cleanup(stop)
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, listener, config, DefaultCartLimits(), cartUpdater, MustRedisCartReader(MustRedisTestClient()))
+	}()
+
+	return "http://" + listener.Addr().String(), ctx, served
+}
+
+func postCartUpdate(url string, cartID string) (*http.Response, error) {
+	return http.Post(
+		url+"/update_cart",
+		"application/json",
+		bytes.NewBufferString(fmt.Sprintf(`{"cart_id": "%s", "cart_details": {"food": {"diner": 1}}}`, cartID)),
+	)
+}
+
+func TestServeDrainsInFlightUpdatesWhenSignalled(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := &blockingCartUpdater{MustRedisCartUpdater(client), make(chan struct{}), make(chan struct{})}
+	url, ctx, served := mustServe(t, testHTTPConfig(5*time.Second), updater)
+	cartID := uuid.NewV4().String()
+
+	responses := make(chan *http.Response, 1)
+	errs := make(chan error, 1)
+	go func() {
+		response, err := postCartUpdate(url, cartID)
+		responses <- response
+		errs <- err
+	}()
+	<-updater.updating
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	<-ctx.Done()
+	// stops accepting requests while the update is still in flight
+	require.Eventually(t, func() bool {
+		_, err := http.Get(url + "/read_cart?cart_id=" + cartID)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	close(updater.unblock)
+
+	response := <-responses
+	require.NoError(t, <-errs)
+	response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.NoError(t, <-served)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+}
+
+func TestServeReleasesLocksOfUpdatesOutlastingShutdownTimeoutWhenSignalled(t *testing.T) {
+	client := MustRedisTestClient()
+	updater := &blockingCartUpdater{MustRedisCartUpdater(client), make(chan struct{}), make(chan struct{})}
+	defer close(updater.unblock)
+	url, _, served := mustServe(t, testHTTPConfig(50*time.Millisecond), updater)
+	cartID := uuid.NewV4().String()
+
+	go postCartUpdate(url, cartID)
+	<-updater.updating
+	locked, err := client.Exists(context.Background(), lockingSemaphore(cartID)).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), locked)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+
+	err = <-served
+	require.Error(t, err)
+	require.Regexp(t, "error draining in-flight requests", err.Error())
+	locked, err = client.Exists(context.Background(), lockingSemaphore(cartID)).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), locked)
+}
+
+func TestRouterAppliesTimeoutOfRoute(t *testing.T) {
+	config := DefaultConfig().HTTP
+	config.ReadTimeout = Duration(time.Second)
+	config.UpdateTimeout = Duration(time.Minute)
+	var timeout time.Duration
+	router := newRouter(
+		config,
+		DefaultCartLimits(),
+		&MockCartUpdater{
+			TestUpdateCartWithContext: func(ctx context.Context, cartID string, updaterFunc func(*Cart) *Cart) error {
+				deadline, ok := ctx.Deadline()
+				require.True(t, ok)
+				timeout = time.Until(deadline)
+				return nil
+			},
+		},
+		&MockCartReader{
+			TestReadCartWithContext: func(ctx context.Context, cartID string) (Cart, error) {
+				deadline, ok := ctx.Deadline()
+				require.True(t, ok)
+				timeout = time.Until(deadline)
+				return NewCart(cartID), nil
+			},
+		},
+		nil,
+	)
+
+	serveRouter(t, router, "GET", "/carts/cart", "", nil)
+	require.LessOrEqual(t, int64(timeout), int64(time.Second))
+
+	serveRouter(t, router, "PATCH", "/carts/cart", "{}", nil)
+	require.Greater(t, int64(timeout), int64(59*time.Second))
+}
+
+// serves a request with the router, decoding any successful JSON response into body
+func serveRouter(t *testing.T, router http.Handler, method string, url string, requestBody string, body interface{}) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(method, url, bytes.NewBufferString(requestBody))
+	require.NoError(t, err)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	if body != nil && response.Code < http.StatusMultipleChoices {
+		// decoding into maps merges into what they already hold
+		reflect.ValueOf(body).Elem().Set(reflect.Zero(reflect.TypeOf(body).Elem()))
+		require.NoError(t, json.NewDecoder(response.Body).Decode(body))
+	}
+
+	return response
+}
+
+func mustRedisRouter() (*redis.Client, http.Handler) {
+	client := MustRedisTestClient()
+
+	return client, newRouter(DefaultConfig().HTTP, DefaultCartLimits(), MustRedisCartUpdater(client), MustRedisCartReader(client), nil)
+}
+
+func TestRouterServesCartsByPath(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	var cart Cart
+
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1}}}`, &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, cartID, cart.CartID)
+
+	response = serveRouter(t, router, "PATCH", "/carts/"+cartID, fmt.Sprintf(`{"cart_id": "%s", "cart_details": {"drink": {"diner2": 2}}}`, cartID), &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1}, "drink": {"diner2": 2}}, cart.CartDetails)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1}, "drink": {"diner2": 2}}, cart.CartDetails)
+	require.Empty(t, response.Header().Get("Deprecation"))
+
+	response = serveRouter(t, router, "PUT", "/carts/"+cartID, `{"cart_details": {"dessert": {"diner1": 3}}}`, &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"dessert": {"diner1": 3}}, cart.CartDetails)
+
+	response = serveRouter(t, router, "DELETE", "/carts/"+cartID, "", nil)
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Empty(t, cart.CartDetails)
+}
+
+func TestRouterServesItemsAndDinersOfCartsByPath(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	var itemDetails ItemDetails
+	var quantity quantityBody
+	var items map[ItemID]int
+
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID+"/items/food", `{"diner1": 1, "diner2": 2}`, &itemDetails)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, ItemDetails{"diner1": 1, "diner2": 2}, itemDetails)
+
+	response = serveRouter(t, router, "PUT", "/carts/"+cartID+"/items/drink", `{"diner1": 3}`, &itemDetails)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, ItemDetails{"diner1": 3}, itemDetails)
+
+	response = serveRouter(t, router, "PUT", "/carts/"+cartID+"/items/food", `{"diner2": 4}`, &itemDetails)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, ItemDetails{"diner2": 4}, itemDetails)
+
+	response = serveRouter(t, router, "PUT", "/carts/"+cartID+"/items/food/diners/diner1", `{"quantity": 5}`, &quantity)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, 5, quantity.Quantity)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/items/food", "", &itemDetails)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, ItemDetails{"diner1": 5, "diner2": 4}, itemDetails)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/items/food/diners/diner2", "", &quantity)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, 4, quantity.Quantity)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/diners/diner1", "", &items)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]int{"food": 5, "drink": 3}, items)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/items/dessert", "", nil)
+	require.Equal(t, http.StatusNotFound, response.Code)
+	require.Equal(t, notFoundProblem, mustDecodeProblem(t, response).Code)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/items/drink/diners/diner2", "", nil)
+	require.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestRouterRejectsCartIDInBodyThatDisagreesWithPath(t *testing.T) {
+	client, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	otherCartID := uuid.NewV4().String()
+
+	for _, method := range []string{"PATCH", "PUT"} {
+		response := serveRouter(t, router, method, "/carts/"+cartID, fmt.Sprintf(`{"cart_id": "%s", "cart_details": {"food": {"diner": 1}}}`, otherCartID), nil)
+
+		require.Equal(t, http.StatusBadRequest, response.Code, method)
+		problem := mustDecodeProblem(t, response)
+		require.Equal(t, badRequestProblem, problem.Code)
+		require.Regexp(t, "does not match", problem.Detail)
+	}
+	for _, id := range []string{cartID, otherCartID} {
+		cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), id)
+		require.NoError(t, err)
+		require.Empty(t, cart.CartDetails)
+	}
+}
+
+func TestRouterServesDeprecatedRoutesWithDeprecationHeader(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	var cart Cart
+
+	response := serveRouter(t, router, "POST", "/update_cart", fmt.Sprintf(`{"cart_id": "%s", "cart_details": {"food": {"diner": 1}}}`, cartID), &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, "true", response.Header().Get("Deprecation"))
+
+	response = serveRouter(t, router, "GET", "/read_cart?cart_id="+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, "true", response.Header().Get("Deprecation"))
+	require.Regexp(t, "successor-version", response.Header().Get("Link"))
+	require.Equal(t, 1, cart.CartDetails["food"]["diner"])
+}
+
+func TestRouterRejectsUnsupportedMethods(t *testing.T) {
+	_, router := mustRedisRouter()
+
+	response := serveRouter(t, router, "POST", "/carts/"+uuid.NewV4().String(), "{}", nil)
+
+	require.Equal(t, http.StatusMethodNotAllowed, response.Code)
+	require.Equal(t, methodNotAllowedProblem, mustDecodeProblem(t, response).Code)
+
+	response = serveRouter(t, router, "GET", "/carts", "", nil)
+
+	require.Equal(t, http.StatusNotFound, response.Code)
+	require.Equal(t, notFoundProblem, mustDecodeProblem(t, response).Code)
+}
+
+func TestRouterReportsEveryInvalidFieldOfUpdates(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": -1, "diner2": 1000}}}`, nil)
+
+	require.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	problem := mustDecodeProblem(t, response)
+	require.Equal(t, validationProblem, problem.Code)
+	require.Equal(t, []FieldError{
+		{Field: "cart_details.food.diner1", Message: "must not be negative"},
+		{Field: "cart_details.food.diner2", Message: "must be at most 99"},
+	}, problem.Errors)
+}
+
+func TestRouterRemovesItemsAndDiners(t *testing.T) {
+	client, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{
+		"food":    {"diner1": 1, "diner2": 2},
+		"drink":   {"diner1": 1, "diner3": 3},
+		"dessert": {"diner2": 1},
+		"side":    {"diner3": 1},
+	}}, false)
+	var cart Cart
+
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"side": {"diner3": 0}}}`, &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.NotContains(t, cart.CartDetails, ItemID("side"))
+
+	response = serveRouter(t, router, "DELETE", "/carts/"+cartID+"/items/dessert", "", nil)
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	response = serveRouter(t, router, "DELETE", "/carts/"+cartID+"/items/drink/diners/diner3", "", nil)
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	response = serveRouter(t, router, "DELETE", "/carts/"+cartID+"/diners/diner1", "", nil)
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner2": 2}}, cart.CartDetails)
+
+	// removing what is not in the cart is not an error
+	response = serveRouter(t, router, "DELETE", "/carts/"+cartID+"/diners/diner1", "", nil)
+	require.Equal(t, http.StatusNoContent, response.Code)
+}
+
+func TestRouterRemovesItemsReplacedWithoutDiners(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	var cart Cart
+
+	response := serveRouter(t, router, "PUT", "/carts/"+cartID, `{"cart_details": {"food": {"diner1": 1, "diner2": 0}, "drink": {}}}`, &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 1}}, cart.CartDetails)
+
+	var itemDetails ItemDetails
+	response = serveRouter(t, router, "PUT", "/carts/"+cartID+"/items/food", `{"diner1": 0}`, &itemDetails)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, ItemDetails{}, itemDetails)
+
+	response = serveRouter(t, router, "GET", "/carts/"+cartID+"/items/food", "", nil)
+	require.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestRouterAppliesOperations(t *testing.T) {
+	client, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner1": 1}, "drink": {"diner1": 1}}}, false)
+	var body operationsResponse
+
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"operations": [
+		{"op": "inc", "item_id": "food", "diner_id": "diner1", "amount": 2},
+		{"op": "set", "item_id": "food", "diner_id": "diner2", "amount": 1},
+		{"op": "remove", "item_id": "drink"}
+	]}`, &body)
+
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner1": 3, "diner2": 1}}, body.Cart.CartDetails)
+	require.Equal(t, []OperationResult{
+		{Operation: Operation{Op: IncrementOperation, ItemID: "food", DinerID: "diner1", Amount: 2}, Quantity: 3},
+		{Operation: Operation{Op: SetOperation, ItemID: "food", DinerID: "diner2", Amount: 1}, Quantity: 1},
+		{Operation: Operation{Op: RemoveOperation, ItemID: "drink"}, Quantity: 0},
+	}, body.Results)
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, body.Cart.CartDetails, cart.CartDetails)
+}
+
+func TestRouterAppliesConcurrentIncrementsOfTheSameQuantity(t *testing.T) {
+	client, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	const diners = 5
+
+	done := make(chan int, diners)
+	for diner := 0; diner < diners; diner++ {
+		go func() {
+			done <- serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"operations": [{"op": "inc", "item_id": "food", "diner_id": "table", "amount": 1}]}`, nil).Code
+		}()
+	}
+	for diner := 0; diner < diners; diner++ {
+		require.Equal(t, http.StatusOK, <-done)
+	}
+
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, diners, cart.CartDetails["food"]["table"])
+}
+
+func TestRouterAppliesNoOperationsUnlessAllAreValid(t *testing.T) {
+	client, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	mustStoreCart(t, client, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{"food": {"diner": 98}}}, false)
+
+	for _, testCase := range []struct {
+		body     string
+		expected []FieldError
+	}{
+		{
+			body:     `{"operations": [{"op": "inc", "item_id": "food", "diner_id": "diner", "amount": 1}, {"op": "inc", "item_id": "food", "amount": 1}]}`,
+			expected: []FieldError{{Field: "operations[1].diner_id", Message: "must not be empty"}},
+		},
+		{
+			body:     `{"operations": [{"op": "inc", "item_id": "drink", "diner_id": "diner", "amount": 1}, {"op": "inc", "item_id": "food", "diner_id": "diner", "amount": 2}]}`,
+			expected: []FieldError{{Field: "cart_details.food.diner", Message: "must be at most 99"}},
+		},
+		{
+			body:     `{"cart_details": {"drink": {"diner": 1}}, "operations": []}`,
+			expected: []FieldError{{Field: "operations", Message: "must not be given along with cart_details"}},
+		},
+	} {
+		response := serveRouter(t, router, "PATCH", "/carts/"+cartID, testCase.body, nil)
+
+		require.Equal(t, http.StatusUnprocessableEntity, response.Code, testCase.body)
+		require.Equal(t, testCase.expected, mustDecodeProblem(t, response).Errors)
+	}
+	cart, err := MustRedisCartReader(client).ReadCartWithContext(context.Background(), cartID)
+	require.NoError(t, err)
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 98}}, cart.CartDetails)
+}
+
+func TestRouterTagsCartsWithVersions(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	response := serveRouter(t, router, "GET", "/carts/"+cartID, "", nil)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"0"`, response.Header().Get("ETag"))
+
+	response = serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+
+	for _, path := range []string{"", "/items/food", "/items/food/diners/diner", "/diners/diner"} {
+		request := httptest.NewRequest("GET", "/carts/"+cartID+path, nil)
+		request.Header.Set("If-None-Match", `"0", W/"1"`)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		require.Equal(t, http.StatusNotModified, response.Code)
+		require.Equal(t, `"1"`, response.Header().Get("ETag"))
+		require.Empty(t, response.Body.String())
+	}
+
+	request := httptest.NewRequest("GET", "/carts/"+cartID, nil)
+	request.Header.Set("If-None-Match", `"0"`)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+}
+
+func TestRouterOnlyMatchesIfNoneMatchAnyAgainstCartsThatExist(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	request := httptest.NewRequest("GET", "/carts/"+cartID, nil)
+	request.Header.Set("If-None-Match", "*")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"0"`, response.Header().Get("ETag"))
+
+	response = serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	request = httptest.NewRequest("GET", "/carts/"+cartID, nil)
+	request.Header.Set("If-None-Match", "*")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	require.Equal(t, http.StatusNotModified, response.Code)
+	require.Equal(t, `"1"`, response.Header().Get("ETag"))
+}
+
+func TestRouterOnlyUpdatesCartsMatchingIfMatch(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	for _, testCase := range []struct {
+		ifMatch string
+		status  int
+		code    string
+	}{
+		{`"0"`, http.StatusPreconditionFailed, versionMismatchProblem},
+		{`W/"1"`, http.StatusPreconditionFailed, versionMismatchProblem},
+		{`"0", "2"`, http.StatusPreconditionFailed, versionMismatchProblem},
+	} {
+		request := httptest.NewRequest("PUT", "/carts/"+cartID+"/items/food/diners/diner", strings.NewReader(`{"quantity": 2}`))
+		request.Header.Set("If-Match", testCase.ifMatch)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		require.Equal(t, testCase.status, response.Code, testCase.ifMatch)
+		require.Equal(t, testCase.code, mustDecodeProblem(t, response).Code)
+	}
+
+	for _, ifMatch := range []string{`"1"`, `"0", "2"`, "*"} {
+		request := httptest.NewRequest("PUT", "/carts/"+cartID+"/items/food/diners/diner", strings.NewReader(`{"quantity": 2}`))
+		request.Header.Set("If-Match", ifMatch)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		require.Equal(t, http.StatusOK, response.Code, ifMatch)
+	}
+
+	var cart Cart
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"4"`, response.Header().Get("ETag"))
+	require.Equal(t, map[ItemID]ItemDetails{"food": {"diner": 2}}, cart.CartDetails)
+}
+
+func TestRouterOnlyUpdatesCartsThatExistGivenIfMatchAny(t *testing.T) {
+	_, router := mustRedisRouter()
+	cartID := uuid.NewV4().String()
+
+	request := httptest.NewRequest("PUT", "/carts/"+cartID+"/items/food/diners/diner", strings.NewReader(`{"quantity": 2}`))
+	request.Header.Set("If-Match", "*")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	require.Equal(t, http.StatusPreconditionFailed, response.Code)
+	require.Equal(t, versionMismatchProblem, mustDecodeProblem(t, response).Code)
+
+	var cart Cart
+	response = serveRouter(t, router, "GET", "/carts/"+cartID, "", &cart)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, `"0"`, response.Header().Get("ETag"))
+	require.Empty(t, cart.CartDetails)
+}
+
+func TestServeEndsCartEventStreamsWhenSignalled(t *testing.T) {
+	url, ctx, served := mustServe(t, testHTTPConfig(5*time.Second), MustRedisCartUpdater(MustRedisTestClient()))
+	events := mustWatchCart(t, url+"/carts/"+uuid.NewV4().String()+"/events", "")
+	mustReadEvent(t, events, false)
+
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+	<-ctx.Done()
+
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "streams of events held up shutdown")
+	}
+}
+
+func TestServeEndsPollsWhenSignalled(t *testing.T) {
+	url, ctx, served := mustServe(t, testHTTPConfig(5*time.Second), MustRedisCartUpdater(MustRedisTestClient()))
+	polled := make(chan *http.Response, 1)
+	go func() {
+		response, err := http.Get(url + "/carts/" + uuid.NewV4().String() + "?wait_for_version_gt=0")
+		if err == nil {
+			response.Body.Close()
+		}
+		polled <- response
+	}()
+	// gives the poll the time to start waiting
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+	<-ctx.Done()
+
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "polls held up shutdown")
+	}
+	response := <-polled
+	require.NotNil(t, response)
+	require.Equal(t, http.StatusNotModified, response.StatusCode)
+	require.Equal(t, `"0"`, response.Header.Get("ETag"))
+}
+
+func TestServeEndsCollaborationsWhenSignalled(t *testing.T) {
+	url, ctx, served := mustServe(t, testHTTPConfig(5*time.Second), MustRedisCartUpdater(MustRedisTestClient()))
+	collaborator := mustCollaborate(t, url, uuid.NewV4().String())
+	collaborator.mustReceive()
+
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+	<-ctx.Done()
+
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "collaborations held up shutdown")
+	}
+	_, _, err := collaborator.conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+}
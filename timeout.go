@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RequestTimeoutHeader lets clients ask for a deadline shorter than that of
+// the route, as a duration such as "500ms", longer ones being capped to it
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// reports whether err is down to the deadline of the request expiring,
+// which redis errors such as i/o timeouts do not always wrap
+func deadlineExceeded(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == context.DeadlineExceeded
+}
+
+// withTimeout serves requests with a context that expires after maxTimeout,
+// or after the timeout requested by the client if that is sooner
+func withTimeout(maxTimeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := maxTimeout
+		if header := r.Header.Get(RequestTimeoutHeader); header != "" {
+			requested, err := time.ParseDuration(header)
+			if err != nil || requested <= 0 {
+				writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("%s must be a positive duration such as \"500ms\"", RequestTimeoutHeader), nil)
+				return
+			}
+			if requested < timeout {
+				timeout = requested
+			}
+		}
+
+		ctx, cancelFunc := context.WithTimeout(r.Context(), timeout)
+		defer cancelFunc()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serves a request through withTimeout and returns the context it was
+// handled with, which must have been cancelled by the time it returns
+func serveWithTimeout(t *testing.T, maxTimeout time.Duration, requestTimeout string) (*httptest.ResponseRecorder, time.Duration) {
+	request, err := http.NewRequest("GET", "/read_cart", nil)
+	require.NoError(t, err)
+	if requestTimeout != "" {
+		request.Header.Set(RequestTimeoutHeader, requestTimeout)
+	}
+
+	var ctx context.Context
+	var timeout time.Duration
+	response := httptest.NewRecorder()
+	withTimeout(maxTimeout, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+		deadline, ok := ctx.Deadline()
+		require.True(t, ok)
+		timeout = time.Until(deadline)
+	})).ServeHTTP(response, request)
+
+	if ctx != nil {
+		require.Error(t, ctx.Err())
+	}
+
+	return response, timeout
+}
+
+func TestWithTimeoutAppliesMaxTimeoutGivenNoRequestTimeout(t *testing.T) {
+	_, timeout := serveWithTimeout(t, time.Minute, "")
+
+	require.Greater(t, int64(timeout), int64(59*time.Second))
+}
+
+func TestWithTimeoutAppliesRequestTimeoutIfShorter(t *testing.T) {
+	_, timeout := serveWithTimeout(t, time.Minute, "500ms")
+
+	require.LessOrEqual(t, int64(timeout), int64(500*time.Millisecond))
+	require.Greater(t, int64(timeout), int64(0))
+}
+
+func TestWithTimeoutCapsRequestTimeoutAtMaxTimeout(t *testing.T) {
+	_, timeout := serveWithTimeout(t, time.Second, "1h")
+
+	require.LessOrEqual(t, int64(timeout), int64(time.Second))
+	require.Greater(t, int64(timeout), int64(500*time.Millisecond))
+}
+
+func TestWithTimeoutReturnsErrorIfRequestTimeoutIsInvalid(t *testing.T) {
+	for _, requestTimeout := range []string{"soon", "-1s", "0s"} {
+		response, _ := serveWithTimeout(t, time.Second, requestTimeout)
+
+		require.Equal(t, http.StatusBadRequest, response.Code, requestTimeout)
+		problem := mustDecodeProblem(t, response)
+		require.Equal(t, badRequestProblem, problem.Code)
+		require.Regexp(t, RequestTimeoutHeader, problem.Detail)
+	}
+}
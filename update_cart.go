@@ -3,50 +3,383 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+
+	"github.com/gorilla/mux"
 )
 
 // TODO: log and report errors to monitoring tools appropriately
 func UpdateCartWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
-	var updates Cart
+	switch requestMediaType(r) {
+	case MergePatchMediaType, JSONPatchMediaType:
+		PatchCartWithContext(ctx, cartUpdater, w, r)
+		return
+	}
+
+	updates, cartID, ok := decodeCartUpdates(w, r)
+	if !ok {
+		return
+	}
+	if updates.Operations != nil {
+		applyOperationsWithContext(ctx, cartUpdater, w, r, cartID, updates)
+		return
+	}
+
+	finalCart, ok := mergeCart(ctx, cartUpdater, w, r, cartID, updates.Cart)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, finalCart)
+}
+
+// the response to updates given as operations
+type operationsResponse struct {
+	Cart    *Cart             `json:"cart"`
+	Results []OperationResult `json:"results"`
+}
+
+// applies the operations in a single update, all or none of them
+func applyOperationsWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request, cartID string, updates cartUpdates) {
+	if updates.CartDetails != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, validationProblem, "the cart is invalid", []FieldError{
+			{Field: "operations", Message: "must not be given along with cart_details"},
+		})
+		return
+	}
+	if err := validateOperations(updates.Operations); err != nil {
+		writeErrorProblem(ctx, w, err)
+		return
+	}
+
+	var results []OperationResult
+	finalCart, ok := updateCart(ctx, cartUpdater, w, r, cartID, func(currentCart *Cart) *Cart {
+		// from scratch since the update may be retried
+		results = applyOperations(currentCart, updates.Operations)
+		return currentCart
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, operationsResponse{Cart: finalCart, Results: results})
+}
+
+// ReplaceCartWithContext replaces the whole cart with the one in the body
+func ReplaceCartWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	updates, cartID, ok := decodeCartUpdates(w, r)
+	if !ok {
+		return
+	}
+	if updates.Operations != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, validationProblem, "the cart is invalid", []FieldError{
+			{Field: "operations", Message: "must not be given when replacing a cart"},
+		})
+		return
+	}
+
+	finalCart, ok := updateCart(ctx, cartUpdater, w, r, cartID, func(*Cart) *Cart {
+		replacement := NewCart(cartID)
+		return compareAndUpdateCart(&replacement, updates.Cart)
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, finalCart)
+}
+
+// DeleteCartWithContext empties the cart, which is all there is to deleting it
+func DeleteCartWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+
+	_, ok = updateCart(ctx, cartUpdater, w, r, cartID, func(*Cart) *Cart {
+		emptyCart := NewCart(cartID)
+		return &emptyCart
+	})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateItemWithContext merges the quantities by diner in the body into the item
+func UpdateItemWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, itemID, itemDetails, ok := decodeItemUpdates(w, r)
+	if !ok {
+		return
+	}
+
+	finalCart, ok := mergeCart(ctx, cartUpdater, w, r, cartID, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{itemID: itemDetails}})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, itemOrEmpty(finalCart, itemID))
+}
+
+// ReplaceItemWithContext replaces the quantities by diner of the item with those in the body
+func ReplaceItemWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, itemID, itemDetails, ok := decodeItemUpdates(w, r)
+	if !ok {
+		return
+	}
+
+	finalCart, ok := updateCart(ctx, cartUpdater, w, r, cartID, func(currentCart *Cart) *Cart {
+		delete(currentCart.CartDetails, itemID)
+		return compareAndUpdateCart(currentCart, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{itemID: itemDetails}})
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, itemOrEmpty(finalCart, itemID))
+}
+
+// ReplaceItemDinerWithContext sets the quantity of the item for the diner
+func ReplaceItemDinerWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+	itemID, dinerID := ItemID(mux.Vars(r)["itemID"]), DinerID(mux.Vars(r)["dinerID"])
+
+	var body quantityBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Println(err.Error())
+		writeDecodingProblem(w, err)
+		return
+	}
+
+	_, ok = mergeCart(ctx, cartUpdater, w, r, cartID, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{itemID: {dinerID: body.Quantity}}})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
+
+// DeleteItemWithContext removes the item for every diner
+func DeleteItemWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+	itemID := ItemID(mux.Vars(r)["itemID"])
+
+	_, ok = mergeCart(ctx, cartUpdater, w, r, cartID, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{itemID: {}}})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteItemDinerWithContext removes the item for the diner only
+func DeleteItemDinerWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+	itemID, dinerID := ItemID(mux.Vars(r)["itemID"]), DinerID(mux.Vars(r)["dinerID"])
+
+	_, ok = mergeCart(ctx, cartUpdater, w, r, cartID, Cart{CartID: cartID, CartDetails: map[ItemID]ItemDetails{itemID: {dinerID: 0}}})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteDinerWithContext removes every item for the diner
+func DeleteDinerWithContext(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return
+	}
+	dinerID := DinerID(mux.Vars(r)["dinerID"])
+
+	_, ok = updateCart(ctx, cartUpdater, w, r, cartID, func(currentCart *Cart) *Cart {
+		removals := NewCart(cartID)
+		for itemID := range dinerItems(*currentCart, dinerID) {
+			removals.CartDetails[itemID] = ItemDetails{dinerID: 0}
+		}
+		return compareAndUpdateCart(currentCart, removals)
+	})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// items that were removed have no diners rather than none at all
+func itemOrEmpty(cart *Cart, itemID ItemID) ItemDetails {
+	if itemDetails, ok := cart.CartDetails[itemID]; ok {
+		return itemDetails
+	}
+
+	return ItemDetails{}
+}
+
+// the body of updates, either a snapshot of the cart to merge into it
+// or operations to apply to it, but never both
+type cartUpdates struct {
+	Cart
+	Operations []Operation `json:"operations"`
+}
+
+// decodes updates from the body whose cart ID, if any, must agree with the path,
+// the body being all there is to go by on the deprecated routes
+func decodeCartUpdates(w http.ResponseWriter, r *http.Request) (cartUpdates, string, bool) {
+	var updates cartUpdates
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&updates); err != nil {
 		log.Println(err.Error())
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+		writeDecodingProblem(w, err)
+		return cartUpdates{}, "", false
+	}
+
+	cartID, ok := mux.Vars(r)["cartID"]
+	if !ok {
+		return updates, updates.CartID, true
+	}
+	if updates.CartID != "" && updates.CartID != cartID {
+		writeProblem(w, http.StatusBadRequest, badRequestProblem, "cart_id in body does not match the cart in the path", nil)
+		return cartUpdates{}, "", false
+	}
+
+	return updates, cartID, true
+}
+
+// decodes the quantities by diner of the item in the path from the body
+func decodeItemUpdates(w http.ResponseWriter, r *http.Request) (string, ItemID, ItemDetails, bool) {
+	cartID, ok := cartIDFromRequest(r)
+	if !ok {
+		writeMissingCartIDProblem(w)
+		return "", "", nil, false
+	}
+
+	var itemDetails ItemDetails
+	if err := json.NewDecoder(r.Body).Decode(&itemDetails); err != nil {
+		log.Println(err.Error())
+		writeDecodingProblem(w, err)
+		return "", "", nil, false
+	}
+
+	return cartID, ItemID(mux.Vars(r)["itemID"]), itemDetails, true
+}
+
+// merges the updates into the cart as compareAndUpdateCart does, in a single
+// round trip if the updater is also a CartMerger and the update is unconditional
+func mergeCart(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request, cartID string, updates Cart) (*Cart, bool) {
+	merger, ok := cartUpdater.(CartMerger)
+	if !ok || r.Header.Get("If-Match") != "" {
+		return updateCart(ctx, cartUpdater, w, r, cartID, func(currentCart *Cart) *Cart {
+			return compareAndUpdateCart(currentCart, updates)
+		})
+	}
+
+	finalCart, err := merger.MergeCartWithContext(ctx, cartID, updates)
+	if err != nil {
+		log.Println(err.Error())
+		writeErrorProblem(ctx, w, err)
+		return nil, false
+	}
+
+	w.Header().Set("ETag", cartETag(finalCart.Version))
+	return &finalCart, true
+}
+
+// updates the cart, at a version in If-Match if any, responding with
+// the error if any and otherwise tagging the response with the new version
+func updateCart(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request, cartID string, updaterFunc func(*Cart) *Cart) (*Cart, bool) {
+	return updateCartOrAbort(ctx, cartUpdater, w, r, cartID, func(currentCart *Cart) (*Cart, error) {
+		return updaterFunc(currentCart), nil
+	})
+}
+
+// same as updateCart, except that an error from updaterFunc
+// aborts the update and is the error responded with
+func updateCartOrAbort(ctx context.Context, cartUpdater CartUpdater, w http.ResponseWriter, r *http.Request, cartID string, updaterFunc func(*Cart) (*Cart, error)) (*Cart, bool) {
+	versions, ok := ifMatchVersions(w, r)
+	if !ok {
+		return nil, false
 	}
 
 	var finalCart *Cart
-	// TODO: move cartID to path variable
-	err := cartUpdater.UpdateCartWithContext(ctx, updates.CartID, func(currentCart *Cart) *Cart {
-		finalCart = compareAndUpdateCart(currentCart, updates)
+	var abortErr error
+	trackingUpdaterFunc := func(currentCart *Cart) *Cart {
+		// checked once the cart is locked or watched so that it cannot change in between
+		if len(versions) > 0 && !matchesVersions(currentCart, versions) {
+			abortErr = fmt.Errorf("error updating cart at version %d: %w", currentCart.Version, ErrVersionMismatch)
+			return nil
+		}
+		finalCart, abortErr = updaterFunc(currentCart)
+		if abortErr != nil {
+			return nil
+		}
 		return finalCart
-	})
+	}
+	var err error
+	if len(versions) == 1 && versions[0] != existingVersion {
+		err = cartUpdater.UpdateCartIfVersionWithContext(ctx, cartID, versions[0], trackingUpdaterFunc)
+	} else {
+		err = cartUpdater.UpdateCartWithContext(ctx, cartID, trackingUpdaterFunc)
+	}
+	if errors.Is(err, ErrUpdateAborted) && abortErr != nil {
+		err = abortErr
+	}
 	if err != nil {
 		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		writeErrorProblem(ctx, w, err)
+		return nil, false
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(finalCart); err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	// in case the updater returned without calling updaterFunc
+	if finalCart != nil {
+		w.Header().Set("ETag", cartETag(finalCart.Version))
 	}
+	return finalCart, true
 }
 
 // TODO: define conflict resolution logic as you best see fit
+//
+// quantities in the updates overwrite those in the cart, except that
+// a quantity of zero removes the diner from the item and an item with
+// no diners in the updates is removed altogether, as is any item that
+// is left with no diners since it could not be stored
 func compareAndUpdateCart(currentCart *Cart, updates Cart) *Cart {
-	for itemID := range updates.CartDetails {
-		if _, ok := currentCart.CartDetails[itemID]; !ok {
-			currentCart.CartDetails[itemID] = updates.CartDetails[itemID]
+	for itemID, itemDetails := range updates.CartDetails {
+		if len(itemDetails) == 0 {
+			delete(currentCart.CartDetails, itemID)
 			continue
 		}
 
-		for dinerID := range updates.CartDetails[itemID] {
-			currentCart.CartDetails[itemID][dinerID] = updates.CartDetails[itemID][dinerID]
+		if _, ok := currentCart.CartDetails[itemID]; !ok {
+			currentCart.CartDetails[itemID] = make(ItemDetails)
+		}
+		for dinerID, quantity := range itemDetails {
+			if quantity == 0 {
+				delete(currentCart.CartDetails[itemID], dinerID)
+				continue
+			}
+			currentCart.CartDetails[itemID][dinerID] = quantity
+		}
+		if len(currentCart.CartDetails[itemID]) == 0 {
+			delete(currentCart.CartDetails, itemID)
 		}
 	}
 
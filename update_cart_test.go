@@ -15,13 +15,18 @@ import (
 )
 
 type MockCartUpdater struct {
-	TestUpdateCartWithContext func(context.Context, string, func(*Cart) *Cart) error
+	TestUpdateCartWithContext          func(context.Context, string, func(*Cart) *Cart) error
+	TestUpdateCartIfVersionWithContext func(context.Context, string, int64, func(*Cart) *Cart) error
 }
 
 func (m *MockCartUpdater) UpdateCartWithContext(ctx context.Context, cartID string, updaterFunc func(*Cart) *Cart) error {
 	return m.TestUpdateCartWithContext(ctx, cartID, updaterFunc)
 }
 
+func (m *MockCartUpdater) UpdateCartIfVersionWithContext(ctx context.Context, cartID string, version int64, updaterFunc func(*Cart) *Cart) error {
+	return m.TestUpdateCartIfVersionWithContext(ctx, cartID, version, updaterFunc)
+}
+
 func TestUpdateCartWithContextReturnsErrorIfRequestIsNotJSON(t *testing.T) {
 	request, err := http.NewRequest("POST", "/update_cart", bytes.NewBuffer([]byte("totally not JSON")))
 	require.NoError(t, err)
@@ -31,6 +36,7 @@ func TestUpdateCartWithContextReturnsErrorIfRequestIsNotJSON(t *testing.T) {
 	UpdateCartWithContext(context.Background(), &MockCartUpdater{}, response, request)
 
 	require.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	require.Equal(t, validationProblem, mustDecodeProblem(t, response).Code)
 }
 
 func TestUpdateCartWithContextReturnsErrorIfInvalidJSON(t *testing.T) {
@@ -43,6 +49,9 @@ func TestUpdateCartWithContextReturnsErrorIfInvalidJSON(t *testing.T) {
 	UpdateCartWithContext(context.Background(), &MockCartUpdater{}, response, request)
 
 	require.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	problem := mustDecodeProblem(t, response)
+	require.Equal(t, validationProblem, problem.Code)
+	require.Equal(t, []FieldError{{Field: "cart_id", Message: "must be of type string"}}, problem.Errors)
 }
 
 func TestUpdateCartWithContextReturnsErrorIfErrorUpdatingCart(t *testing.T) {
@@ -67,12 +76,13 @@ func TestUpdateCartWithContextReturnsErrorIfErrorUpdatingCart(t *testing.T) {
 	require.Equal(t, http.StatusInternalServerError, response.Code)
 }
 
-func TestUpdateCartWithContextReturnsErrorIfContextTimesOut(t *testing.T) {
+func TestUpdateCartWithContextReturnsGatewayTimeoutIfContextTimesOut(t *testing.T) {
 	id := uuid.NewV4().String()
 	request, err := http.NewRequest("POST", "/update_cart", bytes.NewBuffer([]byte(fmt.Sprintf(`{"cart_id": "%s"}`, id))))
 	require.NoError(t, err)
 
-	ctx, _ := context.WithTimeout(context.Background(), 0*time.Second)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 0*time.Second)
+	defer cancelFunc()
 	response := httptest.NewRecorder()
 	// can be nil because should not be invoked
 	UpdateCartWithContext(
@@ -86,7 +96,8 @@ func TestUpdateCartWithContextReturnsErrorIfContextTimesOut(t *testing.T) {
 		request,
 	)
 
-	require.Equal(t, http.StatusInternalServerError, response.Code)
+	require.Equal(t, http.StatusGatewayTimeout, response.Code)
+	require.Equal(t, deadlineProblem, mustDecodeProblem(t, response).Code)
 }
 
 func TestUpdateCartWithContextReplacesEmptyCart(t *testing.T) {
@@ -165,4 +176,121 @@ func TestUpdateCartWithContextModifiesExistingCart(t *testing.T) {
 	require.Equal(t, 1, cart.CartDetails["food"]["diner2"])
 }
 
-// TODO: implement tests for compareAndUpdateCart
+// shared with the tests of RedisScriptCartMerger, which must merge identically
+var compareAndUpdateCartTestCases = []struct {
+	name     string
+	current  map[ItemID]ItemDetails
+	updates  map[ItemID]ItemDetails
+	expected map[ItemID]ItemDetails
+}{
+	{
+		name:     "adds items to an empty cart",
+		current:  nil,
+		updates:  map[ItemID]ItemDetails{"food": {"diner": 1}},
+		expected: map[ItemID]ItemDetails{"food": {"diner": 1}},
+	},
+	{
+		name:     "adds new items to an existing cart",
+		current:  map[ItemID]ItemDetails{"food": {"diner": 1}},
+		updates:  map[ItemID]ItemDetails{"drink": {"diner": 2}},
+		expected: map[ItemID]ItemDetails{"food": {"diner": 1}, "drink": {"diner": 2}},
+	},
+	{
+		name:     "adds new diners to an existing item",
+		current:  map[ItemID]ItemDetails{"food": {"diner1": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner2": 2}},
+		expected: map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}},
+	},
+	{
+		name:     "overwrites quantities of existing diners",
+		current:  map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner2": 3}},
+		expected: map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 3}},
+	},
+	{
+		name:     "leaves items missing from the updates untouched",
+		current:  map[ItemID]ItemDetails{"food": {"diner": 1}, "drink": {"diner": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner": 2}},
+		expected: map[ItemID]ItemDetails{"food": {"diner": 2}, "drink": {"diner": 1}},
+	},
+	{
+		name:     "leaves the cart untouched given no updates",
+		current:  map[ItemID]ItemDetails{"food": {"diner": 1}},
+		updates:  nil,
+		expected: map[ItemID]ItemDetails{"food": {"diner": 1}},
+	},
+	{
+		name:     "removes diners given a zero quantity",
+		current:  map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner2": 0}},
+		expected: map[ItemID]ItemDetails{"food": {"diner1": 1}},
+	},
+	{
+		name:     "removes items left without diners",
+		current:  map[ItemID]ItemDetails{"food": {"diner": 1}, "drink": {"diner": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner": 0}},
+		expected: map[ItemID]ItemDetails{"drink": {"diner": 1}},
+	},
+	{
+		name:     "removes items given no diners",
+		current:  map[ItemID]ItemDetails{"food": {"diner1": 1, "diner2": 2}, "drink": {"diner1": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {}},
+		expected: map[ItemID]ItemDetails{"drink": {"diner1": 1}},
+	},
+	{
+		name:     "removes only the item given no diners even if others share its prefix",
+		current:  map[ItemID]ItemDetails{"food": {"diner": 1}, "food2": {"diner": 1}, `food",`: {"diner": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {}},
+		expected: map[ItemID]ItemDetails{"food2": {"diner": 1}, `food",`: {"diner": 1}},
+	},
+	{
+		name:     "ignores removals of diners and items not in the cart",
+		current:  map[ItemID]ItemDetails{"food": {"diner1": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner2": 0}, "drink": {}, "dessert": {"diner1": 0}},
+		expected: map[ItemID]ItemDetails{"food": {"diner1": 1}},
+	},
+	{
+		name:     "removes and adds in the same update",
+		current:  map[ItemID]ItemDetails{"food": {"diner1": 1}, "drink": {"diner1": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner1": 0, "diner2": 2}, "drink": {}, "dessert": {"diner1": 3}},
+		expected: map[ItemID]ItemDetails{"food": {"diner2": 2}, "dessert": {"diner1": 3}},
+	},
+	{
+		name:     "leaves an empty cart given only removals",
+		current:  map[ItemID]ItemDetails{"food": {"diner": 1}},
+		updates:  map[ItemID]ItemDetails{"food": {"diner": 0}},
+		expected: map[ItemID]ItemDetails{},
+	},
+}
+
+func TestCompareAndUpdateCart(t *testing.T) {
+	for _, testCase := range compareAndUpdateCartTestCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			currentCart := NewCart("cart")
+			for itemID, itemDetails := range copyCartDetails(testCase.current) {
+				currentCart.CartDetails[itemID] = itemDetails
+			}
+
+			updatedCart := compareAndUpdateCart(&currentCart, Cart{CartID: "cart", CartDetails: copyCartDetails(testCase.updates)})
+
+			require.Equal(t, testCase.expected, updatedCart.CartDetails)
+		})
+	}
+}
+
+// test cases are shared so must never be mutated by the code under test
+func copyCartDetails(cartDetails map[ItemID]ItemDetails) map[ItemID]ItemDetails {
+	if cartDetails == nil {
+		return nil
+	}
+
+	copied := make(map[ItemID]ItemDetails)
+	for itemID, itemDetails := range cartDetails {
+		copied[itemID] = make(ItemDetails)
+		for dinerID, quantity := range itemDetails {
+			copied[itemID][dinerID] = quantity
+		}
+	}
+
+	return copied
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gorilla/mux"
+)
+
+// the formats of the events streamed, given by the format query param
+const (
+	// every event is the whole cart
+	cartEventFormat = "cart"
+	// events after the first are JSON Merge Patches of the cart last streamed
+	patchEventFormat = "patch"
+)
+
+// streams the changes of the cart as server-sent events, starting with the
+// cart as it is unless it is still at the version in Last-Event-ID, until the
+// client disconnects or stop is closed, with heartbeats while idle
+func watchCart(heartbeatInterval time.Duration, readTimeout time.Duration, cartReader CartReader, stop <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cartID := mux.Vars(r)["cartID"]
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = cartEventFormat
+		}
+		if format != cartEventFormat && format != patchEventFormat {
+			writeProblem(w, http.StatusBadRequest, badRequestProblem, fmt.Sprintf("format must be either %s or %s", cartEventFormat, patchEventFormat), nil)
+			return
+		}
+		cartWatcher, ok := cartReader.(CartWatcher)
+		if !ok {
+			writeProblem(w, http.StatusNotImplemented, notImplementedProblem, "carts cannot be watched", nil)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeProblem(w, http.StatusInternalServerError, internalProblem, "events cannot be streamed", nil)
+			return
+		}
+
+		ctx, cancelFunc := context.WithCancel(r.Context())
+		defer cancelFunc()
+		go func() {
+			select {
+			case <-stop:
+				cancelFunc()
+			case <-ctx.Done():
+			}
+		}()
+
+		events, currentCart, ok := watchThenReadCart(ctx, cartWatcher, cartReader, readTimeout, w, cartID)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		lastVersion, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+		if err != nil {
+			lastVersion = -1
+		}
+		lastCart, _ := json.Marshal(currentCart)
+		if currentCart.Version != lastVersion {
+			// clients have nothing to patch to begin with
+			writeEvent(w, currentCart.Version, cartEventFormat, lastCart)
+			lastVersion = currentCart.Version
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				// events may arrive out of order or predate the cart first streamed
+				if event.Version <= lastVersion {
+					continue
+				}
+
+				data, _ := json.Marshal(event.Cart)
+				if format == cartEventFormat {
+					writeEvent(w, event.Version, cartEventFormat, data)
+				} else {
+					patch, err := jsonpatch.CreateMergePatch(lastCart, data)
+					if err != nil {
+						log.Println(err.Error())
+						return
+					}
+					writeEvent(w, event.Version, patchEventFormat, patch)
+				}
+				lastVersion, lastCart = event.Version, data
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// watches the cart then reads it, watching first so that no change is missed
+// in between, responding with a problem if either fails
+func watchThenReadCart(ctx context.Context, cartWatcher CartWatcher, cartReader CartReader, readTimeout time.Duration, w http.ResponseWriter, cartID string) (<-chan CartEvent, Cart, bool) {
+	events, err := cartWatcher.WatchCartWithContext(ctx, cartID)
+	if err != nil {
+		log.Println(err.Error())
+		writeErrorProblem(ctx, w, err)
+		return nil, Cart{}, false
+	}
+	readCtx, cancelRead := context.WithTimeout(ctx, readTimeout)
+	defer cancelRead()
+	currentCart, err := cartReader.ReadCartWithContext(readCtx, cartID)
+	if err != nil {
+		log.Println(err.Error())
+		writeErrorProblem(readCtx, w, err)
+		return nil, Cart{}, false
+	}
+
+	return events, currentCart, true
+}
+
+// writes an event whose data is on a single line, as JSON encoded by go is
+func writeEvent(w http.ResponseWriter, version int64, name string, data []byte) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", version, name, data)
+}
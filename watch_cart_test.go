@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type serverSentEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// reads the next event, skipping comments such as heartbeats unless asked for
+func mustReadEvent(t *testing.T, reader *bufio.Reader, comments bool) serverSentEvent {
+	var event serverSentEvent
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && event != (serverSentEvent{}):
+			return event
+		case strings.HasPrefix(line, ":") && comments:
+			return serverSentEvent{data: line}
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func mustWatchCart(t *testing.T, url string, lastEventID string) *bufio.Reader {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	t.Cleanup(cancelFunc)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	t.Cleanup(func() { response.Body.Close() })
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	return bufio.NewReader(response.Body)
+}
+
+func TestRouterStreamsCartEvents(t *testing.T) {
+	_, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+
+	events := mustWatchCart(t, server.URL+"/carts/"+cartID+"/events", "")
+	require.Equal(t, serverSentEvent{id: "0", event: "cart", data: `{"cart_id":"` + cartID + `","cart_details":{}}`}, mustReadEvent(t, events, false))
+
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, serverSentEvent{id: "1", event: "cart", data: `{"cart_id":"` + cartID + `","cart_details":{"food":{"diner":1}}}`}, mustReadEvent(t, events, false))
+}
+
+func TestRouterStreamsCartEventsAsMergePatches(t *testing.T) {
+	_, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}, "drink": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	events := mustWatchCart(t, server.URL+"/carts/"+cartID+"/events?format=patch", "")
+	require.Equal(t, "cart", mustReadEvent(t, events, false).event)
+
+	response = serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 2}, "drink": {}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, serverSentEvent{id: "2", event: "patch", data: `{"cart_details":{"drink":null,"food":{"diner":2}}}`}, mustReadEvent(t, events, false))
+}
+
+func TestRouterResumesCartEventsFromLastEventID(t *testing.T) {
+	_, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+	response := serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 1}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	// resuming from a version behind streams the cart as it is now
+	events := mustWatchCart(t, server.URL+"/carts/"+cartID+"/events", "0")
+	require.Equal(t, "1", mustReadEvent(t, events, false).id)
+
+	// whereas resuming from the version it is at streams only later changes
+	events = mustWatchCart(t, server.URL+"/carts/"+cartID+"/events", "1")
+	response = serveRouter(t, router, "PATCH", "/carts/"+cartID, `{"cart_details": {"food": {"diner": 2}}}`, nil)
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Equal(t, "2", mustReadEvent(t, events, false).id)
+}
+
+func TestRouterSendsHeartbeatsOnIdleCartEvents(t *testing.T) {
+	client := MustRedisTestClient()
+	config := DefaultConfig().HTTP
+	config.HeartbeatInterval = Duration(10 * time.Millisecond)
+	server := httptest.NewServer(newRouter(config, DefaultCartLimits(), MustRedisCartUpdater(client), MustRedisCartReader(client), nil))
+	t.Cleanup(server.Close)
+
+	events := mustWatchCart(t, server.URL+"/carts/"+uuid.NewV4().String()+"/events", "")
+	require.Equal(t, "cart", mustReadEvent(t, events, false).event)
+
+	require.Equal(t, ": heartbeat", mustReadEvent(t, events, true).data)
+}
+
+func TestRouterRejectsUnknownCartEventFormats(t *testing.T) {
+	_, router := mustRedisRouter()
+
+	response := serveRouter(t, router, "GET", "/carts/cart/events?format=xml", "", nil)
+
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	require.Equal(t, badRequestProblem, mustDecodeProblem(t, response).Code)
+}
+
+func TestRouterStopsWatchingCartOnceClientDisconnects(t *testing.T) {
+	client, router := mustRedisRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	cartID := uuid.NewV4().String()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/carts/"+cartID+"/events", nil)
+	require.NoError(t, err)
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	mustReadEvent(t, bufio.NewReader(response.Body), false)
+
+	cancelFunc()
+
+	require.Eventually(t, func() bool {
+		subscribers, err := client.PubSubNumSub(context.Background(), cartEvents(cartID)).Result()
+		return err == nil && subscribers[cartEvents(cartID)] == 0
+	}, time.Second, 10*time.Millisecond)
+}